@@ -3,35 +3,62 @@ package broker
 
 import (
 	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/flike/golog"
 
 	"github.com/labstack/echo"
 	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/calendar"
+	"github.com/the-no/kingtask/core/clock"
 	"github.com/the-no/kingtask/core/errors"
-	"github.com/the-no/kingtask/core/timer"
+	"github.com/the-no/kingtask/store"
 	"github.com/the-no/kingtask/task"
 	"github.com/tylerb/graceful"
-	redis "gopkg.in/redis.v5"
 )
 
+const promoteBatchSize = 1000
+
+//列出延时任务时默认返回的个数
+const scheduledListLimit = 100
+
+//列出延时任务时最多返回的个数，更大的limit按此截断
+const scheduledListMaxLimit = 1000
+
+var queueNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
 type Broker struct {
-	cfg         *config.BrokerConfig
-	addr        string
-	redisAddr   string
-	redisDB     int
-	running     bool
-	web         *echo.Echo
-	redisClient *redis.Client
-	timer       *timer.Timer
+	cfg     *config.BrokerConfig
+	addr    string
+	running bool
+	web     *echo.Echo
+	store   store.Store
+	//calendar_path下加载的排除日历
+	calendars map[string]*calendar.Calendar
+	id        string
+	//是否持有leader租约，1表示持有
+	leader int32
+	//调度使用的时钟，测试中可替换为clock.Manual
+	clock clock.Clock
 }
 
 func NewBroker(cfg *config.BrokerConfig) (*Broker, error) {
-	var err error
+	s, err := store.NewRedisStore(cfg.RedisAddr)
+	if err != nil {
+		golog.Error("broker", "NewBroker", "new redis store fail", 0, "err", err.Error())
+		return nil, err
+	}
+	return NewBrokerWithStore(cfg, s)
+}
 
+//使用指定的存储创建broker，例如store.NewMemoryStore()
+func NewBrokerWithStore(cfg *config.BrokerConfig, s store.Store) (*Broker, error) {
 	broker := new(Broker)
 	broker.cfg = cfg
 	broker.addr = cfg.Addr
@@ -39,35 +66,32 @@ func NewBroker(cfg *config.BrokerConfig) (*Broker, error) {
 		return nil, errors.ErrInvalidArgument
 	}
 
-	vec := strings.SplitN(cfg.RedisAddr, "/", 2)
-	if len(vec) == 2 {
-		broker.redisAddr = vec[0]
-		broker.redisDB, err = strconv.Atoi(vec[1])
+	broker.calendars = make(map[string]*calendar.Calendar)
+	if len(cfg.CalendarPath) != 0 {
+		calendars, err := calendar.LoadDir(cfg.CalendarPath)
 		if err != nil {
+			golog.Error("broker", "NewBrokerWithStore", "load calendars fail", 0,
+				"calendar_path", cfg.CalendarPath, "err", err.Error())
 			return nil, err
 		}
-	} else {
-		broker.redisAddr = vec[0]
-		broker.redisDB = config.DefaultRedisDB
+		broker.calendars = calendars
 	}
 
-	broker.web = echo.New()
-
-	broker.timer = timer.New(time.Millisecond * 10)
-	go broker.timer.Start()
-
-	broker.redisClient = redis.NewClient(
-		&redis.Options{
-			Addr:     broker.redisAddr,
-			Password: "", // no password set
-			DB:       broker.redisDB,
-		},
-	)
-	_, err = broker.redisClient.Ping().Result()
-	if err != nil {
-		golog.Error("broker", "NewBroker", "ping redis fail", 0, "err", err.Error())
-		return nil, err
+	broker.id = cfg.BrokerId
+	if len(broker.id) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		broker.id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
 	}
+	if broker.cfg.LeaderLease <= 0 {
+		broker.cfg.LeaderLease = config.DefaultLeaderLease
+	}
+
+	broker.web = echo.New()
+	broker.store = s
+	broker.clock = clock.Real
 
 	return broker, nil
 }
@@ -76,61 +100,337 @@ func (b *Broker) Run() {
 	b.running = true
 	b.RegisterMiddleware()
 	b.RegisterURL()
+	go b.HandleLeader()
 	go b.HandleFailTask()
+	go b.HandleFinishTask()
+	go b.HandleDelayTask()
+	go b.HandleExpiredLease()
+	go b.HandleSchedule()
 	graceful.ListenAndServe(b.web.Server, 5*time.Second)
 }
 
 func (b *Broker) Close() {
 	b.running = false
-	b.redisClient.Close()
-	b.timer.Stop()
+	//主动释放leader租约，其他broker无需等待租约过期
+	if b.IsLeader() {
+		b.store.ReleaseLeader(b.id)
+	}
+	b.store.Close()
+}
+
+//所有broker都提供HTTP API，只有持有leader租约的broker运行后台任务，
+//每隔租约时长的三分之一续约一次，续约失败时立即停止后台任务
+func (b *Broker) HandleLeader() error {
+	lease := time.Second * time.Duration(b.cfg.LeaderLease)
+	for b.running {
+		ok, err := b.store.AcquireLeader(b.id, lease)
+		if err != nil {
+			golog.Error("Broker", "HandleLeader", "acquire leader error", 0,
+				"broker_id", b.id, "error", err.Error())
+			ok = false
+		}
+		if ok && atomic.SwapInt32(&b.leader, 1) == 0 {
+			golog.Info("Broker", "HandleLeader", "become leader", 0, "broker_id", b.id)
+		}
+		if !ok && atomic.SwapInt32(&b.leader, 0) == 1 {
+			golog.Warn("Broker", "HandleLeader", "lose leader", 0, "broker_id", b.id)
+		}
+		time.Sleep(lease / 3)
+	}
+	return nil
+}
+
+//替换调度使用的时钟，需在Run之前设置，
+//leader租约由存储按真实时间计算，不受影响
+func (b *Broker) SetClock(c clock.Clock) {
+	b.clock = c
+}
+
+func (b *Broker) IsLeader() bool {
+	return atomic.LoadInt32(&b.leader) == 1
+}
+
+//当前持有leader租约的broker id
+func (b *Broker) HandleGetLeader() (string, error) {
+	return b.store.Leader()
 }
 
 func (b *Broker) HandleTaskResult(uuid string) (*task.Reply, error) {
 	if len(uuid) == 0 {
 		return nil, errors.ErrInvalidArgument
 	}
-	key := fmt.Sprintf("r_%s", uuid)
-	result, err := b.redisClient.HMGet(key,
-		"is_success",
-		"result",
-	).Result()
+	result, err := b.store.GetResult(uuid)
 	if err != nil {
-		golog.Error("Broker", "HandleTaskResult", err.Error(), 0, "req_key", key)
+		if err != errors.ErrResultNotExist {
+			golog.Error("Broker", "HandleTaskResult", err.Error(), 0,
+				"req_key", fmt.Sprintf("r_%s", uuid))
+		}
 		return nil, err
 	}
 
-	//key不存在
-	if result[0] == nil {
-		return nil, errors.ErrResultNotExist
-	}
-	isSuccess, err := strconv.Atoi(result[0].(string))
-	if err != nil {
-		return nil, err
+	state := result.State
+	if len(state) == 0 {
+		state = task.StateFailure
+		if result.IsSuccess == int64(1) {
+			state = task.StateSuccess
+		}
 	}
-	ret := result[1].(string)
 	return &task.Reply{
 		IsResultExist: 1,
-		IsSuccess:     isSuccess,
-		Result:        ret,
+		IsSuccess:     int(result.IsSuccess),
+		Result:        result.Result,
+		State:         state,
+		ErrorClass:    result.ErrorClass,
+		ErrorCode:     result.ErrorCode,
 	}, nil
 }
 
+//取消任务，等待执行、延时和等待重试的任务不再执行，
+//执行中的任务在完成后不再重试
+func (b *Broker) HandleCancelTask(uuid string) error {
+	if len(uuid) == 0 {
+		return errors.ErrInvalidArgument
+	}
+	request, err := b.store.GetRequest(uuid)
+	if err == errors.ErrRequestNotExist {
+		//请求已删除，只有等待重试的失败任务可以取消
+		result, err := b.store.GetResult(uuid)
+		if err == errors.ErrResultNotExist {
+			return errors.ErrRequestNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if result.IsSuccess == int64(1) || !willRetry(result) {
+			return errors.ErrTaskFinished
+		}
+		request = &result.TaskRequest
+	} else if err != nil {
+		return err
+	}
+	//等待父节点的工作流节点不在任何队列中，直接取消
+	if len(request.Workflow) != 0 {
+		pending, err := b.cancelWorkflowNode(request)
+		if err != nil {
+			return err
+		}
+		if pending {
+			golog.Info("Broker", "HandleCancelTask", "workflow node cancelled", 0,
+				"key", fmt.Sprintf("t_%s", uuid), "workflow", request.Workflow)
+			return nil
+		}
+	}
+
+	waiting, err := b.store.Cancel(uuid, time.Second*config.CancelTaskKeepTime)
+	if err != nil {
+		golog.Error("Broker", "HandleCancelTask", "cancel error", 0,
+			"key", fmt.Sprintf("t_%s", uuid), "err", err.Error())
+		return err
+	}
+	//执行中和等待重试的任务分别由worker和HandleFailTask记录结果
+	if waiting {
+		b.releaseOrderKey(request)
+		b.setCancelledResult(request)
+	}
+	golog.Info("Broker", "HandleCancelTask", "task cancelled", 0,
+		"key", fmt.Sprintf("t_%s", uuid), "waiting", waiting)
+	return nil
+}
+
+func (b *Broker) setCancelledResult(r *task.TaskRequest) {
+	result := &task.TaskResult{
+		TaskRequest: *r,
+		IsSuccess:   int64(0),
+		Result:      errors.ErrTaskCancelled.Error(),
+		State:       task.StateCancelled,
+	}
+	err := b.store.SaveResult(result, time.Second*config.CancelTaskKeepTime)
+	if err != nil {
+		golog.Error("Broker", "setCancelledResult", err.Error(), 0,
+			"key", fmt.Sprintf("t_%s", r.Uuid))
+	}
+	b.finishTask(result)
+}
+
+//失败的任务是否还会重试，和resetTaskRequest一致
+func willRetry(result *task.TaskResult) bool {
+	if result.State == task.StateExpired {
+		return false
+	}
+	if !result.Retryable(result.ErrorClass, result.ErrorCode) {
+		return false
+	}
+	if result.Retry.Enabled() {
+		return result.Retry.CanRetry(result.Index + 1)
+	}
+	if len(result.TimeInterval) == 0 {
+		return false
+	}
+	return result.Index+1 < len(strings.Split(result.TimeInterval, " "))
+}
+
 func (b *Broker) HandleRequest(request *task.TaskRequest) error {
 	var err error
-	now := time.Now().Unix()
+	now := b.clock.Now().Unix()
 	if request.StartTime == 0 {
 		request.StartTime = now
 	}
-
-	if request.StartTime <= now {
-		err = b.AddRequestToRedis(request)
+	err = b.checkRequest(request)
+	if err != nil {
+		return err
+	}
+	if request.TTL < 0 || request.ExpiresAt < 0 {
+		return errors.ErrInvalidArgument
+	}
+	startTime, err := b.allowedTime(request, request.StartTime)
+	if err != nil {
+		return err
+	}
+	//ttl从顺延到允许执行的时刻开始计算
+	if request.ExpiresAt == 0 && request.TTL != 0 {
+		request.ExpiresAt = startTime + request.TTL
+	}
+	//在第一次允许执行之前就已过期
+	if request.ExpiresAt != 0 && (request.ExpiresAt <= now || request.ExpiresAt <= startTime) {
+		return errors.ErrTaskExpired
+	}
+	if len(request.UniqueKey) != 0 {
+		owner, err := b.store.ClaimUniqueKey(request.UniqueKey, request.Uuid, b.idempotencyWindow())
 		if err != nil {
+			golog.Error("Broker", "HandleRequest", "claim unique key error", 0,
+				"unique_key", request.UniqueKey, "err", err.Error())
 			return err
 		}
+		//窗口期内的重复提交，返回已有任务的uuid
+		if owner != request.Uuid {
+			golog.Info("Broker", "HandleRequest", "duplicate request", 0,
+				"unique_key", request.UniqueKey, "uuid", owner)
+			request.Uuid = owner
+			return nil
+		}
+	}
+
+	if startTime <= now {
+		err = b.AddRequestToRedis(request)
 	} else {
-		afterTime := time.Second * time.Duration(request.StartTime-now)
-		b.timer.NewTimer(afterTime, b.AddRequestToRedis, request)
+		err = b.AddDelayRequestToRedis(request, startTime)
+	}
+	if err != nil {
+		//提交失败，允许客户端用同一个key重试
+		if len(request.UniqueKey) != 0 {
+			b.store.ReleaseUniqueKey(request.UniqueKey, request.Uuid)
+		}
+		return err
+	}
+
+	return nil
+}
+
+//补全默认值并检查请求参数
+func (b *Broker) checkRequest(request *task.TaskRequest) error {
+	if request.Priority == 0 {
+		request.Priority = task.PriorityNormal
+	}
+	if request.Priority < task.PriorityLow || task.PriorityHigh < request.Priority {
+		return errors.ErrInvalidArgument
+	}
+	if len(request.Queue) == 0 {
+		request.Queue = task.DefaultQueue
+	}
+	if !queueNameRegexp.MatchString(request.Queue) {
+		return errors.ErrInvalidArgument
+	}
+	err := request.Retry.Validate()
+	if err != nil {
+		return err
+	}
+	err = task.ValidateRetryOn(request.RetryOn)
+	if err != nil {
+		return err
+	}
+	//只指定concurrency_key时同时只执行一个
+	if len(request.ConcurrencyKey) != 0 && request.ConcurrencyLimit == 0 {
+		request.ConcurrencyLimit = 1
+	}
+	if request.ConcurrencyLimit < 0 || len(request.ConcurrencyKey) == 0 && request.ConcurrencyLimit != 0 {
+		return errors.ErrInvalidConcurrency
+	}
+	_, err = b.rule(request)
+	if err != nil {
+		return err
+	}
+	return b.checkFollowUps(request)
+}
+
+//任务的时区、执行时间段和排除日历，都没有指定时返回nil
+func (b *Broker) rule(request *task.TaskRequest) (*calendar.Rule, error) {
+	return calendar.NewRule(request.Timezone, request.Windows, request.Calendars, b.calendars)
+}
+
+//t不在任务允许执行的时间内时，顺延到下一个允许执行的时刻
+func (b *Broker) allowedTime(request *task.TaskRequest, t int64) (int64, error) {
+	r, err := b.rule(request)
+	if err != nil || r == nil {
+		return t, err
+	}
+	next := r.Next(time.Unix(t, 0))
+	if next.IsZero() {
+		return 0, errors.ErrInvalidWindow
+	}
+	return next.Unix(), nil
+}
+
+func (b *Broker) idempotencyWindow() time.Duration {
+	window := b.cfg.IdempotencyWindow
+	if window <= 0 {
+		window = config.DefaultUniqueKeyTime
+	}
+	return time.Second * time.Duration(window)
+}
+
+//将到期的延时任务移入待执行集合
+func (b *Broker) HandleDelayTask() error {
+	for b.running {
+		if !b.IsLeader() {
+			b.clock.Sleep(time.Second)
+			continue
+		}
+		uuids, err := b.store.PromoteDue(b.clock.Now().Unix(), promoteBatchSize)
+		if err != nil {
+			golog.Error("Broker", "HandleDelayTask", "promote error", 0, "error", err.Error())
+			b.clock.Sleep(time.Second)
+			continue
+		}
+		for _, uuid := range uuids {
+			golog.Debug("Broker", "HandleDelayTask", "promote task", 0,
+				"key", fmt.Sprintf("t_%s", uuid))
+		}
+		//本批未取完，继续处理
+		if len(uuids) == promoteBatchSize {
+			continue
+		}
+		b.clock.Sleep(time.Second)
+	}
+
+	return nil
+}
+
+//重新投递租约过期的任务，即执行过程中worker崩溃的任务
+func (b *Broker) HandleExpiredLease() error {
+	for b.running {
+		if !b.IsLeader() {
+			b.clock.Sleep(time.Second)
+			continue
+		}
+		uuids, err := b.store.RequeueExpired(b.clock.Now().Unix())
+		if err != nil {
+			golog.Error("Broker", "HandleExpiredLease", "requeue error", 0, "error", err.Error())
+		}
+		for _, uuid := range uuids {
+			golog.Warn("Broker", "HandleExpiredLease", "lease or concurrency slot expired, requeue task", 0,
+				"key", fmt.Sprintf("t_%s", uuid))
+		}
+		b.clock.Sleep(time.Second)
 	}
 
 	return nil
@@ -141,121 +441,164 @@ func (b *Broker) HandleFailTask() error {
 	var uuid string
 	var err error
 	for b.running {
-		uuid, err = b.redisClient.SPop(config.FailResultUuidSet).Result()
+		if !b.IsLeader() {
+			b.clock.Sleep(time.Second)
+			continue
+		}
+		uuid, err = b.store.PopFailed()
 		//没有结果，直接返回
-		if err == redis.Nil {
-			time.Sleep(time.Second)
+		if err == errors.ErrQueueEmpty {
+			b.clock.Sleep(time.Second)
 			continue
 		}
 		if err != nil {
-			golog.Error("Broker", "HandleFailTask", "spop error", 0, "error", err.Error())
+			golog.Error("Broker", "HandleFailTask", "pop error", 0, "error", err.Error())
+			b.clock.Sleep(time.Second)
 			continue
 		}
 
 		key := fmt.Sprintf("r_%s", uuid)
-		timeInterval, err := b.redisClient.HGet(key, "time_interval").Result()
-		if err != nil {
-			golog.Error("Broker", "HandleFailTask", err.Error(), 0, "key", key)
-			continue
-		}
-		//没有超时重试机制
-		if len(timeInterval) == 0 {
-			b.SetFailTaskCount(fmt.Sprintf("t_%s", uuid))
+		result, err := b.store.GetResult(uuid)
+		//key已经过期
+		if err == errors.ErrResultNotExist {
+			golog.Error("Broker", "HandleFailTask", "result expired", 0, "key", key)
 			continue
 		}
-		//获取结果中所有值,改为逐个获取
-		results, err := b.redisClient.HMGet(key,
-			"uuid",
-			"bin_name",
-			"args",
-			"start_time",
-			"time_interval",
-			"index",
-			"max_run_time",
-			"task_type",
-		).Result()
 		if err != nil {
 			golog.Error("Broker", "HandleFailTask", err.Error(), 0, "key", key)
 			continue
 		}
-		//key已经过期
-		if results[0] == nil {
-			golog.Error("Broker", "HandleFailTask", "result expired", 0, "key", key)
+		//任务已被取消，不再重试
+		if cancelled, _ := b.store.IsCancelled(uuid); cancelled {
+			b.releaseOrderKey(&result.TaskRequest)
+			b.setCancelledResult(&result.TaskRequest)
+			continue
+		}
+		//没有超时重试机制、该类失败不可重试或已达到最多重试次数，保留结果
+		if !willRetry(result) {
+			b.SetFailTaskCount(fmt.Sprintf("t_%s", uuid))
+			b.releaseOrderKey(&result.TaskRequest)
+			b.finishTask(result)
 			continue
 		}
 		//删除结果
-		_, err = b.redisClient.Del(key).Result()
+		err = b.store.DeleteResult(uuid)
 		if err != nil {
 			golog.Error("Broker", "HandleFailTask", "delete result failed", 0, "key", key)
 		}
-		err = b.resetTaskRequest(results)
+		err = b.resetTaskRequest(&result.TaskRequest)
 		if err != nil {
 			golog.Error("Broker", "HandleFailTask", err.Error(), 0, "key", key)
 			b.SetFailTaskCount(fmt.Sprintf("t_%s", uuid))
+			b.releaseOrderKey(&result.TaskRequest)
+			b.finishTask(result)
 		}
 	}
 
 	return nil
 }
 
-func (b *Broker) SetFailTaskCount(reqKey string) error {
-	failTaskKey := fmt.Sprintf(config.FailTaskKey,
-		time.Now().Format(config.TimeFormat))
-	count, err := b.redisClient.Incr(failTaskKey).Result()
-	if err != nil {
-		golog.Error("Worker", "SetFailTaskCount", "Incr", 0, "err", err.Error(),
-			"req_key", reqKey)
-		return err
-	}
-	//第一次设置该key
-	if count == 1 {
-		//保存一个月
-		expireTime := time.Second * time.Duration(60*60*24*30)
-		_, err = b.redisClient.Expire(failTaskKey, expireTime).Result()
+//处理worker写入的到达最终状态的任务
+func (b *Broker) HandleFinishTask() error {
+	for b.running {
+		if !b.IsLeader() {
+			b.clock.Sleep(time.Second)
+			continue
+		}
+		uuid, err := b.store.PopFinished()
+		if err == errors.ErrQueueEmpty {
+			b.clock.Sleep(time.Second)
+			continue
+		}
 		if err != nil {
-			golog.Error("Worker", "SetFailTaskCount", "Expire", 0, "err", err.Error(),
-				"req_key", reqKey)
-			return err
+			golog.Error("Broker", "HandleFinishTask", "pop error", 0, "error", err.Error())
+			b.clock.Sleep(time.Second)
+			continue
 		}
+
+		result, err := b.store.GetResult(uuid)
+		if err != nil {
+			golog.Error("Broker", "HandleFinishTask", err.Error(), 0,
+				"key", fmt.Sprintf("r_%s", uuid))
+			continue
+		}
+		b.finishTask(result)
 	}
+
 	return nil
 }
 
-func (b *Broker) resetTaskRequest(args []interface{}) error {
-	var err error
-	if len(args) == 0 || len(args) != config.TaskRequestItemCount {
-		return errors.ErrInvalidArgument
+//任务到达最终状态：成功、最终失败或取消
+func (b *Broker) finishTask(result *task.TaskResult) {
+	if len(result.Workflow) != 0 {
+		b.advanceWorkflow(result)
 	}
-	request := new(task.TaskRequest)
-	request.Uuid = args[0].(string)
-	request.BinName = args[1].(string)
-	request.Args = args[2].(string)
-	request.StartTime, err = strconv.ParseInt(args[3].(string), 10, 64)
-	if err != nil {
-		return err
+	if len(result.Group) != 0 {
+		b.finishGroupMember(result)
 	}
-	request.TimeInterval = args[4].(string)
-	request.Index, err = strconv.Atoi(args[5].(string))
-	if err != nil {
-		return err
+	if result.IsSuccess == int64(1) && result.OnSuccess != nil {
+		b.submitFollowUp(result, result.OnSuccess)
+	}
+	//过期的任务也算作失败
+	if result.IsSuccess == int64(0) && result.State != task.StateCancelled && result.OnFailure != nil {
+		b.submitFollowUp(result, result.OnFailure)
 	}
-	request.MaxRunTime, err = strconv.ParseInt(args[6].(string), 10, 64)
+}
+
+//任务最终失败后释放order_key，让同一key的下一个任务执行
+func (b *Broker) releaseOrderKey(r *task.TaskRequest) {
+	if len(r.OrderKey) == 0 {
+		return
+	}
+	next, err := b.store.ReleaseOrderKey(r.OrderKey, r.Uuid)
 	if err != nil {
-		return err
+		golog.Error("Broker", "releaseOrderKey", err.Error(), 0,
+			"order_key", r.OrderKey, "uuid", r.Uuid)
+		return
 	}
-	request.TaskType, err = strconv.Atoi(args[7].(string))
+	if len(next) != 0 {
+		golog.Debug("Broker", "releaseOrderKey", "next task", 0,
+			"order_key", r.OrderKey, "key", fmt.Sprintf("t_%s", next))
+	}
+}
+
+func (b *Broker) SetFailTaskCount(reqKey string) error {
+	failTaskKey := fmt.Sprintf(config.FailTaskKey,
+		b.clock.Now().Format(config.TimeFormat))
+	//保存一个月
+	expireTime := time.Second * time.Duration(60*60*24*30)
+	_, err := b.store.IncrCounter(failTaskKey, expireTime)
 	if err != nil {
+		golog.Error("Broker", "SetFailTaskCount", "Incr", 0, "err", err.Error(),
+			"req_key", reqKey)
 		return err
 	}
-	vec := strings.Split(request.TimeInterval, " ")
+	return nil
+}
+
+func (b *Broker) resetTaskRequest(request *task.TaskRequest) error {
 	request.Index++
+	//重试策略优先于time_interval
+	if request.Retry.Enabled() {
+		if !request.Retry.CanRetry(request.Index) {
+			golog.Error("Broker", "HandleFailTask", "retry max time", 0,
+				"key", fmt.Sprintf("t_%s", request.Uuid))
+			return errors.ErrTryMaxTimes
+		}
+		delay := request.Retry.Delay(request.Index, rand.Float64())
+		return b.AddDelayRequestToRedis(request, b.clock.Now().Unix()+delay)
+	}
+
+	vec := strings.Split(request.TimeInterval, " ")
 	if request.Index < len(vec) {
 		timeLater, err := strconv.Atoi(vec[request.Index])
 		if err != nil {
 			return err
 		}
-		afterTime := time.Second * time.Duration(timeLater)
-		b.timer.NewTimer(afterTime, b.AddRequestToRedis, request)
+		err = b.AddDelayRequestToRedis(request, b.clock.Now().Unix()+int64(timeLater))
+		if err != nil {
+			return err
+		}
 	} else {
 		golog.Error("Broker", "HandleFailTask", "retry max time", 0,
 			"key", fmt.Sprintf("t_%s", request.Uuid))
@@ -264,37 +607,29 @@ func (b *Broker) resetTaskRequest(args []interface{}) error {
 	return nil
 }
 
-func (b *Broker) AddRequestToRedis(tr interface{}) error {
-	r, ok := tr.(*task.TaskRequest)
-	if !ok {
-		return errors.ErrInvalidArgument
-	}
-	key := fmt.Sprintf("t_%s", r.Uuid)
-	values := map[string]string{
-		"uuid":          r.Uuid,
-		"bin_name":      r.BinName,
-		"args":          r.Args,
-		"start_time":    strconv.FormatInt(r.StartTime, 10),
-		"time_interval": r.TimeInterval,
-		"index":         strconv.Itoa(r.Index),
-		"max_run_time":  strconv.FormatInt(r.MaxRunTime, 10),
-		"task_type":     strconv.Itoa(r.TaskType),
-	}
-	setCmd := b.redisClient.HMSet(key, values)
-	err := setCmd.Err()
+func (b *Broker) AddRequestToRedis(r *task.TaskRequest) error {
+	err := b.store.Enqueue(r)
 	if err != nil {
-		golog.Error("Broker", "AddRequestToRedis", "HMSET error", 0,
-			"set", config.RequestUuidSet,
+		golog.Error("Broker", "AddRequestToRedis", "enqueue error", 0,
 			"uuid", r.Uuid,
 			"err", err.Error(),
 		)
 		return err
 	}
-	saddCmd := b.redisClient.SAdd(config.RequestUuidSet, r.Uuid)
-	err = saddCmd.Err()
+
+	return nil
+}
+
+//延时任务持久化存储，broker重启后不丢失，
+//startTime不在任务允许执行的时间内时顺延
+func (b *Broker) AddDelayRequestToRedis(r *task.TaskRequest, startTime int64) error {
+	startTime, err := b.allowedTime(r, startTime)
 	if err != nil {
-		golog.Error("Broker", "AddRequestToRedis", "SADD error", 0,
-			"set", config.RequestUuidSet,
+		return err
+	}
+	err = b.store.Schedule(r, startTime)
+	if err != nil {
+		golog.Error("Broker", "AddDelayRequestToRedis", "schedule error", 0,
 			"uuid", r.Uuid,
 			"err", err.Error(),
 		)
@@ -304,51 +639,101 @@ func (b *Broker) AddRequestToRedis(tr interface{}) error {
 	return nil
 }
 
+//所有队列的待执行任务个数
 func (b *Broker) GetUndoTaskCount() (int64, error) {
-	count, err := b.redisClient.SCard(config.RequestUuidSet).Result()
-	if err == redis.Nil {
-		return 0, nil
-	}
+	counts, err := b.GetQueueUndoTaskCounts()
 	if err != nil {
 		return 0, err
 	}
-	return count, nil
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	return total, nil
 }
 
-func (b *Broker) GetFailTaskCount(date string) (int64, error) {
-	if len(date) == 0 {
-		return 0, errors.ErrInvalidArgument
+//延时集合中等待到期的任务
+type ScheduledTask struct {
+	task.TaskRequest
+	ScheduledTime int64 `json:"scheduled_time,string"` //进入待执行队列的时刻
+}
+
+//等待到期的延时任务个数，包括等待重试和被推迟执行的任务
+func (b *Broker) GetScheduledTaskCount() (int64, error) {
+	return b.store.DelayCount()
+}
+
+//按到期时刻从早到晚列出从第offset个开始的最多limit个延时任务
+func (b *Broker) GetScheduledTasks(offset int, limit int) ([]*ScheduledTask, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, errors.ErrInvalidArgument
 	}
-	failTaskKey := fmt.Sprintf(config.FailTaskKey, date)
-	str, err := b.redisClient.Get(failTaskKey).Result()
-	if err == redis.Nil {
-		return 0, nil
+	if scheduledListMaxLimit < limit {
+		limit = scheduledListMaxLimit
 	}
+	delayed, err := b.store.Delayed(offset, limit)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	tasks := make([]*ScheduledTask, 0, len(delayed))
+	for _, d := range delayed {
+		request, err := b.store.GetRequest(d.Uuid)
+		//列出期间已到期或被取消
+		if err != nil {
+			continue
+		}
+		tasks = append(tasks, &ScheduledTask{
+			TaskRequest:   *request,
+			ScheduledTime: d.StartTime,
+		})
 	}
-	count, err := strconv.ParseInt(str, 10, 64)
+	return tasks, nil
+}
+
+func (b *Broker) GetQueueUndoTaskCount(queue string) (int64, error) {
+	if len(queue) == 0 {
+		return 0, errors.ErrInvalidArgument
+	}
+	return b.store.UndoCount(queue)
+}
+
+//每个队列的待执行任务个数
+func (b *Broker) GetQueueUndoTaskCounts() (map[string]int64, error) {
+	queues, err := b.store.Queues()
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	counts := make(map[string]int64, len(queues))
+	for _, queue := range queues {
+		count, err := b.store.UndoCount(queue)
+		if err != nil {
+			return nil, err
+		}
+		counts[queue] = count
 	}
-	return count, nil
+	return counts, nil
 }
 
-func (b *Broker) GetSuccessTaskCount(date string) (int64, error) {
+func (b *Broker) GetFailTaskCount(date string) (int64, error) {
 	if len(date) == 0 {
 		return 0, errors.ErrInvalidArgument
 	}
-	successTaskKey := fmt.Sprintf(config.SuccessTaskKey, date)
-	str, err := b.redisClient.Get(successTaskKey).Result()
-	if err == redis.Nil {
-		return 0, nil
-	}
-	if err != nil {
-		return 0, err
+	failTaskKey := fmt.Sprintf(config.FailTaskKey, date)
+	return b.store.GetCounter(failTaskKey)
+}
+
+func (b *Broker) GetExpiredTaskCount(date string) (int64, error) {
+	if len(date) == 0 {
+		return 0, errors.ErrInvalidArgument
 	}
-	count, err := strconv.ParseInt(str, 10, 64)
-	if err != nil {
-		return 0, err
+	expiredTaskKey := fmt.Sprintf(config.ExpiredTaskKey, date)
+	return b.store.GetCounter(expiredTaskKey)
+}
+
+func (b *Broker) GetSuccessTaskCount(date string) (int64, error) {
+	if len(date) == 0 {
+		return 0, errors.ErrInvalidArgument
 	}
-	return count, nil
+	successTaskKey := fmt.Sprintf(config.SuccessTaskKey, date)
+	return b.store.GetCounter(successTaskKey)
 }
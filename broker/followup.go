@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/flike/golog"
+	"github.com/pborman/uuid"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+)
+
+//检查on_success和on_failure中的后续任务，后续任务也可以有自己的后续任务
+func (b *Broker) checkFollowUps(request *task.TaskRequest) error {
+	for _, child := range []*task.TaskRequest{request.OnSuccess, request.OnFailure} {
+		if child == nil {
+			continue
+		}
+		if len(child.BinName) == 0 {
+			return errors.ErrInvalidArgument
+		}
+		err := b.checkRequest(child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//父任务到达最终状态后提交后续任务，父任务的uuid、状态和结果随任务传给后续任务
+func (b *Broker) submitFollowUp(result *task.TaskResult, followUp *task.TaskRequest) {
+	state := result.State
+	if len(state) == 0 {
+		state = task.StateFailure
+		if result.IsSuccess == int64(1) {
+			state = task.StateSuccess
+		}
+	}
+
+	b.submitChild(result.Uuid, state, result.Result, followUp)
+}
+
+//以followUp为模板创建子任务，parent为父任务的uuid或任务组的id
+func (b *Broker) submitChild(parent string, state string, result string, followUp *task.TaskRequest) {
+	child := *followUp
+	child.Uuid = uuid.New()
+	child.StartTime = 0
+	child.Index = 0
+	child.ParentUuid = parent
+	child.ParentState = state
+	child.ParentResult = result
+	//同一个父任务的结果被重复处理时只提交一次
+	child.UniqueKey = fmt.Sprintf("follow_up:%s:%s", parent, state)
+
+	err := b.HandleRequest(&child)
+	if err != nil {
+		golog.Error("Broker", "submitChild", err.Error(), 0,
+			"parent", parent, "state", state, "bin_name", child.BinName)
+		return
+	}
+	golog.Info("Broker", "submitChild", "ok", 0,
+		"parent", parent, "state", state, "uuid", child.Uuid)
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/flike/golog"
+	"github.com/pborman/uuid"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+)
+
+//创建任务组并提交所有成员，callback可为空
+func (b *Broker) HandleCreateGroup(requests []*task.TaskRequest, callback *task.TaskRequest) (*task.Group, error) {
+	if len(requests) == 0 {
+		return nil, errors.ErrInvalidGroup
+	}
+	g := new(task.Group)
+	g.Id = uuid.New()
+	for _, request := range requests {
+		request.Uuid = uuid.New()
+		request.Group = g.Id
+		request.UniqueKey = ""
+		err := b.checkRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, request.Uuid)
+	}
+	if callback != nil {
+		if len(callback.BinName) == 0 {
+			return nil, errors.ErrInvalidArgument
+		}
+		err := b.checkRequest(callback)
+		if err != nil {
+			return nil, err
+		}
+		g.Callback = callback
+	}
+
+	//先保存任务组，成员完成时才能计数
+	err := b.store.SaveGroup(g)
+	if err != nil {
+		return nil, err
+	}
+	for _, request := range requests {
+		err = b.HandleRequest(request)
+		if err != nil {
+			golog.Error("Broker", "HandleCreateGroup", err.Error(), 0,
+				"group", g.Id, "key", fmt.Sprintf("t_%s", request.Uuid))
+			//提交失败的成员按失败计数，保证任务组能结束
+			result := b.saveResult(request, task.StateFailure, err.Error())
+			b.finishGroupMember(result)
+		}
+	}
+	return g, nil
+}
+
+func (b *Broker) HandleGetGroup(id string) (*task.Group, error) {
+	if len(id) == 0 {
+		return nil, errors.ErrInvalidArgument
+	}
+	return b.store.GetGroup(id)
+}
+
+//成员到达最终状态，取消的成员按失败计数，最后一个成员完成时提交回调任务
+func (b *Broker) finishGroupMember(result *task.TaskResult) {
+	id := result.Group
+	done, err := b.store.FinishGroupMember(id, result.Uuid, result.IsSuccess == int64(1))
+	if err != nil {
+		golog.Error("Broker", "finishGroupMember", err.Error(), 0,
+			"group", id, "uuid", result.Uuid)
+		return
+	}
+	if !done {
+		return
+	}
+
+	g, err := b.store.GetGroup(id)
+	if err != nil {
+		golog.Error("Broker", "finishGroupMember", err.Error(), 0, "group", id)
+		return
+	}
+	golog.Info("Broker", "finishGroupMember", "group finished", 0,
+		"group", id, "completed", g.Completed, "failed", g.Failed)
+	if g.Callback != nil {
+		summary := fmt.Sprintf(`{"total":%d,"completed":%d,"failed":%d}`,
+			len(g.Members), g.Completed, g.Failed)
+		b.submitChild(g.Id, g.State(), summary, g.Callback)
+	}
+}
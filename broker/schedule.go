@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flike/golog"
+	"github.com/pborman/uuid"
+	"github.com/the-no/kingtask/core/calendar"
+	"github.com/the-no/kingtask/core/cron"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+)
+
+//创建周期任务，s.Id为新分配的id
+func (b *Broker) HandleCreateSchedule(s *task.Schedule) error {
+	s.Id = uuid.New()
+	err := b.checkSchedule(s)
+	if err != nil {
+		return err
+	}
+	return b.store.SaveSchedule(s)
+}
+
+//修改周期任务的cron表达式和模板请求，下一次触发时刻按新的表达式计算
+func (b *Broker) HandleUpdateSchedule(s *task.Schedule) error {
+	_, err := b.store.GetSchedule(s.Id)
+	if err != nil {
+		return err
+	}
+	err = b.checkSchedule(s)
+	if err != nil {
+		return err
+	}
+	return b.store.SaveSchedule(s)
+}
+
+func (b *Broker) HandleGetSchedule(id string) (*task.Schedule, error) {
+	if len(id) == 0 {
+		return nil, errors.ErrInvalidArgument
+	}
+	return b.store.GetSchedule(id)
+}
+
+func (b *Broker) HandleListSchedules() ([]*task.Schedule, error) {
+	return b.store.Schedules()
+}
+
+func (b *Broker) HandleDeleteSchedule(id string) error {
+	_, err := b.HandleGetSchedule(id)
+	if err != nil {
+		return err
+	}
+	return b.store.DeleteSchedule(id)
+}
+
+//检查cron表达式和模板请求，并计算下一次触发时刻
+func (b *Broker) checkSchedule(s *task.Schedule) error {
+	cronSchedule, err := cron.Parse(s.Cron)
+	if err != nil {
+		return err
+	}
+	err = b.checkRequest(&s.Request)
+	if err != nil {
+		return err
+	}
+	//cron表达式按任务的时区计算
+	loc, err := calendar.LoadLocation(s.Request.Timezone)
+	if err != nil {
+		return err
+	}
+	next := cronSchedule.Next(b.clock.Now().In(loc))
+	if next.IsZero() {
+		return errors.ErrInvalidCron
+	}
+	s.Request.Uuid = ""
+	s.Request.StartTime = 0
+	s.Request.Index = 0
+	//每次触发的有效期由ttl决定
+	s.Request.ExpiresAt = 0
+	s.NextTime = next.Unix()
+	return nil
+}
+
+//到期的周期任务创建一个新任务并计算下一次触发时刻
+func (b *Broker) HandleSchedule() error {
+	for b.running {
+		if !b.IsLeader() {
+			b.clock.Sleep(time.Second)
+			continue
+		}
+		ids, err := b.store.DueSchedules(b.clock.Now().Unix(), promoteBatchSize)
+		if err != nil {
+			golog.Error("Broker", "HandleSchedule", "due schedules error", 0, "error", err.Error())
+			b.clock.Sleep(time.Second)
+			continue
+		}
+		for _, id := range ids {
+			b.fireSchedule(id)
+		}
+		//本批未取完，继续处理
+		if len(ids) == promoteBatchSize {
+			continue
+		}
+		b.clock.Sleep(time.Second)
+	}
+
+	return nil
+}
+
+func (b *Broker) fireSchedule(id string) {
+	s, err := b.store.GetSchedule(id)
+	if err != nil {
+		golog.Error("Broker", "fireSchedule", err.Error(), 0, "schedule_id", id)
+		return
+	}
+	cronSchedule, err := cron.Parse(s.Cron)
+	if err != nil {
+		golog.Error("Broker", "fireSchedule", err.Error(), 0,
+			"schedule_id", id, "cron", s.Cron)
+		return
+	}
+	loc, err := calendar.LoadLocation(s.Request.Timezone)
+	if err != nil {
+		golog.Error("Broker", "fireSchedule", err.Error(), 0,
+			"schedule_id", id, "timezone", s.Request.Timezone)
+		return
+	}
+	//先提交本次触发的任务，提交失败时周期任务保持不变，下一轮重新触发。
+	//同一次触发使用同一个幂等key，多个broker同时触发或推进失败后重新触发时不会重复提交
+	request := s.Request
+	request.Uuid = uuid.New()
+	request.UniqueKey = fmt.Sprintf("schedule:%s:%d", id, s.NextTime)
+	err = b.HandleRequest(&request)
+	if err != nil {
+		golog.Error("Broker", "fireSchedule", err.Error(), 0,
+			"schedule_id", id, "uuid", request.Uuid)
+		return
+	}
+
+	//broker停止期间错过的触发只执行一次
+	next := cronSchedule.Next(b.clock.Now().In(loc))
+	var ok bool
+	if next.IsZero() {
+		//最后一次触发，删除周期任务
+		ok, err = b.store.FinishSchedule(id, s.NextTime)
+	} else {
+		ok, err = b.store.AdvanceSchedule(id, s.NextTime, next.Unix())
+	}
+	if err != nil {
+		golog.Error("Broker", "fireSchedule", err.Error(), 0, "schedule_id", id)
+		return
+	}
+	//已被其他broker触发
+	if !ok {
+		return
+	}
+	if next.IsZero() {
+		golog.Warn("Broker", "fireSchedule", "schedule never fires again", 0,
+			"schedule_id", id, "cron", s.Cron)
+	}
+	golog.Info("Broker", "fireSchedule", "ok", 0,
+		"schedule_id", id,
+		"uuid", request.Uuid,
+		"next_time", next.Unix(),
+	)
+}
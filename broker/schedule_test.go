@@ -0,0 +1,316 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/clock"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/store"
+	"github.com/the-no/kingtask/task"
+)
+
+func newTestBroker(t *testing.T, now time.Time) (*Broker, *clock.Manual) {
+	return newTestBrokerWithStore(t, now, store.NewMemoryStore())
+}
+
+func newTestBrokerWithStore(t *testing.T, now time.Time, s store.Store) (*Broker, *clock.Manual) {
+	cfg := &config.BrokerConfig{Addr: "127.0.0.1:9595", BrokerId: "test"}
+	b, err := NewBrokerWithStore(cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := clock.NewManual(now)
+	b.SetClock(m)
+	b.running = true
+	b.leader = 1
+	return b, m
+}
+
+//推进时钟并等待后台循环取出到期任务
+func advanceUntil(t *testing.T, b *Broker, m *clock.Manual, d time.Duration, want int64) {
+	m.Advance(d)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, err := b.store.UndoCount(task.DefaultQueue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("undo count=%d, want %d", count, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//等待n个后台循环进入Sleep
+func waitSleeping(m *clock.Manual, n int) {
+	for m.Waiters() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScheduleManualClock(t *testing.T) {
+	b, m := newTestBroker(t, time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC))
+
+	s := &task.Schedule{
+		Cron: "0 * * * *",
+		Request: task.TaskRequest{
+			BinName:  "echo",
+			TaskType: task.ScriptTask,
+			Timezone: "UTC",
+		},
+	}
+	err := b.HandleCreateSchedule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NextTime != time.Date(2026, 1, 1, 1, 0, 0, 0, time.UTC).Unix() {
+		t.Fatalf("next time %d", s.NextTime)
+	}
+
+	go b.HandleSchedule()
+	//每小时触发一次，共24小时
+	for i := int64(1); i <= 24; i++ {
+		waitSleeping(m, 1)
+		advanceUntil(t, b, m, time.Hour, i)
+	}
+	s, err = b.HandleGetSchedule(s.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NextTime != time.Date(2026, 1, 2, 1, 0, 0, 0, time.UTC).Unix() {
+		t.Fatalf("next time %d", s.NextTime)
+	}
+}
+
+//fail为true时提交任务失败，模拟redis不可用
+type failingStore struct {
+	store.Store
+	fail bool
+}
+
+func (s *failingStore) Enqueue(r *task.TaskRequest) error {
+	if s.fail {
+		return fmt.Errorf("store unavailable")
+	}
+	return s.Store.Enqueue(r)
+}
+
+func TestScheduleSubmitFirst(t *testing.T) {
+	st := &failingStore{Store: store.NewMemoryStore(), fail: true}
+	b, _ := newTestBrokerWithStore(t, time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC), st)
+
+	fireTime := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	schedule := &task.Schedule{
+		Id:       "hourly",
+		Cron:     "0 * * * *",
+		NextTime: fireTime,
+		Request: task.TaskRequest{
+			BinName:  "echo",
+			TaskType: task.ScriptTask,
+			Timezone: "UTC",
+		},
+	}
+	err := b.store.SaveSchedule(schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//提交失败时不推进，下一轮重新触发
+	b.fireSchedule("hourly")
+	if s, _ := b.store.GetSchedule("hourly"); s.NextTime != fireTime {
+		t.Fatalf("next time %d, want %d", s.NextTime, fireTime)
+	}
+	st.fail = false
+	b.fireSchedule("hourly")
+	if count, _ := b.store.UndoCount(task.DefaultQueue); count != 1 {
+		t.Fatalf("undo count=%d", count)
+	}
+	nextTime := time.Date(2026, 1, 1, 1, 0, 0, 0, time.UTC).Unix()
+	if s, _ := b.store.GetSchedule("hourly"); s.NextTime != nextTime {
+		t.Fatalf("next time %d, want %d", s.NextTime, nextTime)
+	}
+
+	//同一次触发再次处理时（例如另一个broker或推进失败后）不重复提交
+	b.store.SaveSchedule(schedule)
+	b.fireSchedule("hourly")
+	if count, _ := b.store.UndoCount(task.DefaultQueue); count != 1 {
+		t.Fatalf("undo count=%d", count)
+	}
+	if s, _ := b.store.GetSchedule("hourly"); s.NextTime != nextTime {
+		t.Fatalf("next time %d, want %d", s.NextTime, nextTime)
+	}
+}
+
+func TestScheduleLastFire(t *testing.T) {
+	b, _ := newTestBroker(t, time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC))
+
+	//2月30日不存在，本次触发后不会再触发
+	fireTime := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	err := b.store.SaveSchedule(&task.Schedule{
+		Id:       "never",
+		Cron:     "0 0 30 2 *",
+		NextTime: fireTime,
+		Request: task.TaskRequest{
+			BinName:  "echo",
+			TaskType: task.ScriptTask,
+			Timezone: "UTC",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.fireSchedule("never")
+	if _, err := b.store.GetSchedule("never"); err != errors.ErrScheduleNotExist {
+		t.Fatalf("err=%v", err)
+	}
+	if ids, _ := b.store.DueSchedules(0, 10); len(ids) != 0 {
+		t.Fatalf("due %v", ids)
+	}
+	if count, _ := b.store.UndoCount(task.DefaultQueue); count != 1 {
+		t.Fatalf("undo count=%d", count)
+	}
+	//已删除，重复触发不再提交
+	b.fireSchedule("never")
+	if count, _ := b.store.UndoCount(task.DefaultQueue); count != 1 {
+		t.Fatalf("undo count=%d", count)
+	}
+}
+
+func TestDelayTaskManualClock(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, m := newTestBroker(t, now)
+
+	request := &task.TaskRequest{
+		Uuid:      "delay",
+		BinName:   "echo",
+		TaskType:  task.ScriptTask,
+		StartTime: now.Add(2 * time.Hour).Unix(),
+	}
+	err := b.HandleRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := b.GetScheduledTaskCount()
+	if err != nil || count != 1 {
+		t.Fatalf("scheduled count=%d, err=%v", count, err)
+	}
+	tasks, err := b.GetScheduledTasks(0, scheduledListLimit)
+	if err != nil || len(tasks) != 1 || tasks[0].Uuid != "delay" || tasks[0].ScheduledTime != request.StartTime {
+		t.Fatalf("scheduled tasks %v, err=%v", tasks, err)
+	}
+
+	go b.HandleDelayTask()
+	waitSleeping(m, 1)
+	advanceUntil(t, b, m, time.Hour, 0)
+	waitSleeping(m, 1)
+	advanceUntil(t, b, m, time.Hour, 1)
+	if count, _ := b.GetScheduledTaskCount(); count != 0 {
+		t.Errorf("scheduled count=%d", count)
+	}
+}
+
+func TestScheduledTasksLimit(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, _ := newTestBroker(t, now)
+	for i := 0; i <= scheduledListMaxLimit; i++ {
+		request := &task.TaskRequest{
+			Uuid:     fmt.Sprintf("delay-%d", i),
+			BinName:  "echo",
+			TaskType: task.ScriptTask,
+		}
+		err := b.store.Schedule(request, now.Add(time.Hour).Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//超过上限的limit按上限截断
+	tasks, err := b.GetScheduledTasks(0, scheduledListMaxLimit*2)
+	if err != nil || len(tasks) != scheduledListMaxLimit {
+		t.Fatalf("scheduled tasks %d, err=%v", len(tasks), err)
+	}
+	tasks, err = b.GetScheduledTasks(scheduledListMaxLimit, scheduledListMaxLimit)
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("scheduled tasks %d, err=%v", len(tasks), err)
+	}
+	for _, args := range [][2]int{{-1, 10}, {0, 0}, {0, -1}} {
+		if _, err := b.GetScheduledTasks(args[0], args[1]); err != errors.ErrInvalidArgument {
+			t.Errorf("offset=%d limit=%d err=%v", args[0], args[1], err)
+		}
+	}
+}
+
+func TestWindowTTL(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	b, _ := newTestBroker(t, now)
+
+	//10:00不在窗口内，顺延到第二天01:00，ttl从01:00开始计算
+	request := &task.TaskRequest{
+		Uuid:     "window",
+		BinName:  "echo",
+		TaskType: task.ScriptTask,
+		Timezone: "UTC",
+		Windows:  "01:00-05:00",
+		TTL:      3600,
+	}
+	err := b.HandleRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 1, 0, 0, 0, time.UTC).Unix()
+	if request.ExpiresAt != start+3600 {
+		t.Errorf("expires at %d, want %d", request.ExpiresAt, start+3600)
+	}
+	tasks, _ := b.GetScheduledTasks(0, scheduledListLimit)
+	if len(tasks) != 1 || tasks[0].ScheduledTime != start {
+		t.Fatalf("scheduled tasks %v", tasks)
+	}
+
+	//在第一次允许执行之前就会过期
+	request = &task.TaskRequest{
+		Uuid:      "expired",
+		BinName:   "echo",
+		TaskType:  task.ScriptTask,
+		Timezone:  "UTC",
+		Windows:   "01:00-05:00",
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	if err := b.HandleRequest(request); err != errors.ErrTaskExpired {
+		t.Errorf("err=%v", err)
+	}
+}
+
+func TestRetryManualClock(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, m := newTestBroker(t, now)
+	request := task.TaskRequest{
+		Uuid:         "retry",
+		BinName:      "echo",
+		TaskType:     task.ScriptTask,
+		TimeInterval: "0 3600",
+	}
+	result := &task.TaskResult{TaskRequest: request, IsSuccess: 0, Result: "fail"}
+	b.store.SaveResult(result, time.Hour)
+	b.store.AddFailed(request.Uuid)
+
+	go b.HandleFailTask()
+	go b.HandleDelayTask()
+	//失败的任务按time_interval在1小时后重试
+	waitSleeping(m, 2)
+	tasks, err := b.GetScheduledTasks(0, scheduledListLimit)
+	if err != nil || len(tasks) != 1 || tasks[0].ScheduledTime != now.Add(time.Hour).Unix() {
+		t.Fatalf("scheduled tasks %v, err=%v", tasks, err)
+	}
+	advanceUntil(t, b, m, time.Hour-time.Second, 0)
+	waitSleeping(m, 2)
+	advanceUntil(t, b, m, time.Second, 1)
+}
@@ -2,6 +2,7 @@ package broker
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/flike/golog"
 	"github.com/labstack/echo"
@@ -20,43 +21,69 @@ func (b *Broker) RegisterURL() {
 	b.web.POST("/api/v1/task/script", b.CreateScriptTaskRequest)
 	b.web.POST("/api/v1/task/rpc", b.CreateRpcTaskRequest)
 	b.web.GET("/api/v1/task/result/:uuid", b.GetTaskResult)
+	b.web.DELETE("/api/v1/task/:uuid", b.CancelTask)
 	b.web.GET("/api/v1/task/count/undo", b.UndoTaskCount)
+	b.web.GET("/api/v1/task/count/undo/:queue", b.QueueUndoTaskCount)
+	b.web.GET("/api/v1/task/count/queues", b.QueueUndoTaskCounts)
+	b.web.GET("/api/v1/task/count/scheduled", b.ScheduledTaskCount)
+	b.web.GET("/api/v1/task/scheduled", b.ListScheduledTasks)
 	b.web.GET("/api/v1/task/result/failure/:date", b.FailTaskCount)
 	b.web.GET("/api/v1/task/result/success/:date", b.SuccessTaskCount)
+	b.web.GET("/api/v1/task/result/expired/:date", b.ExpiredTaskCount)
+	b.web.POST("/api/v1/schedule", b.CreateSchedule)
+	b.web.GET("/api/v1/schedule", b.ListSchedules)
+	b.web.GET("/api/v1/schedule/:id", b.GetSchedule)
+	b.web.PUT("/api/v1/schedule/:id", b.UpdateSchedule)
+	b.web.DELETE("/api/v1/schedule/:id", b.DeleteSchedule)
+	b.web.POST("/api/v1/workflow", b.CreateWorkflow)
+	b.web.GET("/api/v1/workflow/:id", b.GetWorkflow)
+	b.web.POST("/api/v1/group", b.CreateGroup)
+	b.web.GET("/api/v1/group/:id", b.GetGroup)
+	b.web.GET("/api/v1/broker/leader", b.GetLeader)
+}
+
+//创建任务的参数，和周期任务、工作流中的任务相比多了幂等提交的key
+type taskArgs struct {
+	UniqueKey string `json:"unique_key"`
+	taskSpec
 }
 
 func (b *Broker) CreateScriptTaskRequest(c echo.Context) error {
-	args := struct {
-		BinName      string `json:"bin_name"`
-		Args         string `json:"args"` //空格分隔各个参数
-		StartTime    int64  `json:"start_time,string"`
-		TimeInterval string `json:"time_interval"` //空格分隔各个参数
-		MaxRunTime   int64  `json:"max_run_time,string"`
-	}{}
+	args := new(taskArgs)
+	err := c.Bind(args)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	//method为空表示脚本任务
+	args.Method = ""
+	return b.createTask(c, args, "CreateScriptTaskRequest")
+}
 
-	err := c.Bind(&args)
+func (b *Broker) CreateRpcTaskRequest(c echo.Context) error {
+	args := new(taskArgs)
+	err := c.Bind(args)
 	if err != nil {
 		return c.JSON(http.StatusForbidden, err.Error())
 	}
-	taskRequest := new(task.TaskRequest)
-	taskRequest.Uuid = uuid.New()
-	if len(args.BinName) == 0 {
+	if len(args.Method) == 0 {
 		return c.JSON(http.StatusForbidden, errors.ErrInvalidArgument.Error())
 	}
+	return b.createTask(c, args, "CreateRpcTaskRequest")
+}
 
-	taskRequest.BinName = args.BinName
-	taskRequest.Args = args.Args
-	taskRequest.StartTime = args.StartTime
-	taskRequest.TimeInterval = args.TimeInterval
-	taskRequest.Index = 0
-	taskRequest.MaxRunTime = args.MaxRunTime
-	taskRequest.TaskType = task.ScriptTask
+func (b *Broker) createTask(c echo.Context, args *taskArgs, handler string) error {
+	taskRequest, err := args.request()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	taskRequest.Uuid = uuid.New()
+	taskRequest.UniqueKey = uniqueKey(c, args.UniqueKey)
 
 	err = b.HandleRequest(taskRequest)
 	if err != nil {
 		return c.JSON(http.StatusForbidden, err.Error())
 	}
-	golog.Info("Broker", "CreateScriptTaskRequest", "ok", 0,
+	golog.Info("Broker", handler, "ok", 0,
 		"uuid", taskRequest.Uuid,
 		"bin_name", taskRequest.BinName,
 		"args", taskRequest.Args,
@@ -65,65 +92,34 @@ func (b *Broker) CreateScriptTaskRequest(c echo.Context) error {
 		"index", taskRequest.Index,
 		"max_run_time", taskRequest.MaxRunTime,
 		"task_type", taskRequest.TaskType,
+		"priority", taskRequest.Priority,
+		"queue", taskRequest.Queue,
+		"order_key", taskRequest.OrderKey,
+		"unique_key", taskRequest.UniqueKey,
 	)
 	return c.JSON(http.StatusOK, taskRequest.Uuid)
 }
 
-func (b *Broker) CreateRpcTaskRequest(c echo.Context) error {
-	args := struct {
-		Method       string `json:"method"`
-		URL          string `json:"url"`
-		Args         string `json:"args"` //json Marshal后的字符串
-		StartTime    int64  `json:"start_time,string"`
-		TimeInterval string `json:"time_interval"` //空格分隔各个参数
-		MaxRunTime   int64  `json:"max_run_time,string"`
-	}{}
-
-	err := c.Bind(&args)
-	if err != nil {
-		return c.JSON(http.StatusForbidden, err.Error())
-	}
-
-	taskRequest := new(task.TaskRequest)
-	taskRequest.Uuid = uuid.New()
-	if len(args.URL) == 0 {
-		return c.JSON(http.StatusForbidden, errors.ErrInvalidArgument.Error())
-	}
-
-	taskRequest.BinName = args.URL
-	taskRequest.Args = args.Args
-	taskRequest.StartTime = args.StartTime
-	taskRequest.TimeInterval = args.TimeInterval
-	taskRequest.Index = 0
-	taskRequest.MaxRunTime = args.MaxRunTime
-	switch args.Method {
+func rpcTaskType(method string) (int, error) {
+	switch method {
 	case "GET":
-		taskRequest.TaskType = task.RpcTaskGET
+		return task.RpcTaskGET, nil
 	case "POST":
-		taskRequest.TaskType = task.RpcTaskPOST
+		return task.RpcTaskPOST, nil
 	case "PUT":
-		taskRequest.TaskType = task.RpcTaskPUT
+		return task.RpcTaskPUT, nil
 	case "DELETE":
-		taskRequest.TaskType = task.RpcTaskDELETE
-	default:
-		return c.JSON(http.StatusForbidden, errors.ErrInvalidArgument.Error())
+		return task.RpcTaskDELETE, nil
 	}
+	return 0, errors.ErrInvalidArgument
+}
 
-	err = b.HandleRequest(taskRequest)
-	if err != nil {
-		return c.JSON(http.StatusForbidden, err.Error())
+//Idempotency-Key头部优先于请求体中的unique_key
+func uniqueKey(c echo.Context, key string) string {
+	if header := c.Request().Header.Get("Idempotency-Key"); len(header) != 0 {
+		return header
 	}
-	golog.Info("Broker", "CreateRpcTaskRequest", "ok", 0,
-		"uuid", taskRequest.Uuid,
-		"bin_name", taskRequest.BinName,
-		"args", taskRequest.Args,
-		"start_time", taskRequest.StartTime,
-		"time_interval", taskRequest.TimeInterval,
-		"index", taskRequest.Index,
-		"max_run_time", taskRequest.MaxRunTime,
-		"task_type", taskRequest.TaskType,
-	)
-	return c.JSON(http.StatusOK, taskRequest.Uuid)
+	return key
 }
 
 func (b *Broker) GetTaskResult(c echo.Context) error {
@@ -139,6 +135,19 @@ func (b *Broker) GetTaskResult(c echo.Context) error {
 	return c.JSON(http.StatusOK, reply)
 }
 
+func (b *Broker) CancelTask(c echo.Context) error {
+	uuid := c.Param("uuid")
+	if len(uuid) == 0 {
+		return c.JSON(http.StatusForbidden, errors.ErrInvalidArgument.Error())
+	}
+
+	err := b.HandleCancelTask(uuid)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, uuid)
+}
+
 func (b *Broker) UndoTaskCount(c echo.Context) error {
 	count, err := b.GetUndoTaskCount()
 	if err != nil {
@@ -147,6 +156,54 @@ func (b *Broker) UndoTaskCount(c echo.Context) error {
 	return c.JSON(http.StatusOK, count)
 }
 
+func (b *Broker) ScheduledTaskCount(c echo.Context) error {
+	count, err := b.GetScheduledTaskCount()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, count)
+}
+
+//offset和limit为可选的查询参数
+func (b *Broker) ListScheduledTasks(c echo.Context) error {
+	offset, limit := 0, scheduledListLimit
+	var err error
+	if param := c.QueryParam("offset"); len(param) != 0 {
+		offset, err = strconv.Atoi(param)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, errors.ErrInvalidArgument.Error())
+		}
+	}
+	if param := c.QueryParam("limit"); len(param) != 0 {
+		limit, err = strconv.Atoi(param)
+		if err != nil {
+			return c.JSON(http.StatusForbidden, errors.ErrInvalidArgument.Error())
+		}
+	}
+	tasks, err := b.GetScheduledTasks(offset, limit)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, tasks)
+}
+
+func (b *Broker) QueueUndoTaskCount(c echo.Context) error {
+	queue := c.Param("queue")
+	count, err := b.GetQueueUndoTaskCount(queue)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, count)
+}
+
+func (b *Broker) QueueUndoTaskCounts(c echo.Context) error {
+	counts, err := b.GetQueueUndoTaskCounts()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, counts)
+}
+
 func (b *Broker) FailTaskCount(c echo.Context) error {
 	date := c.Param("date")
 	count, err := b.GetFailTaskCount(date)
@@ -156,6 +213,15 @@ func (b *Broker) FailTaskCount(c echo.Context) error {
 	return c.JSON(http.StatusOK, count)
 }
 
+func (b *Broker) ExpiredTaskCount(c echo.Context) error {
+	date := c.Param("date")
+	count, err := b.GetExpiredTaskCount(date)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, count)
+}
+
 func (b *Broker) SuccessTaskCount(c echo.Context) error {
 	date := c.Param("date")
 	count, err := b.GetSuccessTaskCount(date)
@@ -164,3 +230,280 @@ func (b *Broker) SuccessTaskCount(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, count)
 }
+
+//任务、周期任务、工作流中任务和后续任务共用的参数，method为空表示脚本任务，否则为RPC任务
+type taskSpec struct {
+	Method       string           `json:"method"`
+	BinName      string           `json:"bin_name"`
+	URL          string           `json:"url"`
+	Args         string           `json:"args"` //脚本任务为空格分隔的参数，RPC任务为请求体
+	StartTime    int64            `json:"start_time,string"`
+	TimeInterval string           `json:"time_interval"` //空格分隔各个参数
+	MaxRunTime   int64            `json:"max_run_time,string"`
+	Priority     int              `json:"priority,string"`
+	Queue        string           `json:"queue"`
+	OrderKey     string           `json:"order_key"`
+	Timezone     string           `json:"timezone"`  //cron表达式和执行时间段的时区
+	Windows      string           `json:"windows"`   //空格分隔各个时间段
+	Calendars    string           `json:"calendars"` //空格分隔各个日历名
+	Retry        task.RetryPolicy `json:"retry"`
+	RetryOn      string           `json:"retry_on"` //空格分隔各个规则
+	RateKey      string           `json:"rate_key"`
+	//相同concurrency_key的任务同时最多执行concurrency_limit个，为0表示1个
+	ConcurrencyKey   string    `json:"concurrency_key"`
+	ConcurrencyLimit int       `json:"concurrency_limit,string"`
+	ExpiresAt        int64     `json:"expires_at,string"`
+	TTL              int64     `json:"ttl,string"` //从start_time开始的有效时长
+	OnSuccess        *taskSpec `json:"on_success"`
+	OnFailure        *taskSpec `json:"on_failure"`
+}
+
+func (spec *taskSpec) request() (*task.TaskRequest, error) {
+	var err error
+	r := new(task.TaskRequest)
+	if len(spec.Method) == 0 {
+		r.BinName = spec.BinName
+		r.TaskType = task.ScriptTask
+	} else {
+		r.BinName = spec.URL
+		r.TaskType, err = rpcTaskType(spec.Method)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(r.BinName) == 0 {
+		return nil, errors.ErrInvalidArgument
+	}
+	r.Args = spec.Args
+	r.StartTime = spec.StartTime
+	r.TimeInterval = spec.TimeInterval
+	r.MaxRunTime = spec.MaxRunTime
+	r.Priority = spec.Priority
+	r.Queue = spec.Queue
+	r.OrderKey = spec.OrderKey
+	r.Timezone = spec.Timezone
+	r.Windows = spec.Windows
+	r.Calendars = spec.Calendars
+	r.Retry = spec.Retry
+	r.RetryOn = spec.RetryOn
+	r.RateKey = spec.RateKey
+	r.ConcurrencyKey = spec.ConcurrencyKey
+	r.ConcurrencyLimit = spec.ConcurrencyLimit
+	r.ExpiresAt = spec.ExpiresAt
+	r.TTL = spec.TTL
+	r.OnSuccess, err = spec.OnSuccess.followUp()
+	if err != nil {
+		return nil, err
+	}
+	r.OnFailure, err = spec.OnFailure.followUp()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//没有指定后续任务时返回nil
+func (spec *taskSpec) followUp() (*task.TaskRequest, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	return spec.request()
+}
+
+func bindSchedule(c echo.Context) (*task.Schedule, error) {
+	args := struct {
+		Cron string `json:"cron"`
+		taskSpec
+	}{}
+
+	err := c.Bind(&args)
+	if err != nil {
+		return nil, err
+	}
+	request, err := args.request()
+	if err != nil {
+		return nil, err
+	}
+	s := new(task.Schedule)
+	s.Cron = args.Cron
+	s.Request = *request
+	return s, nil
+}
+
+func (b *Broker) CreateSchedule(c echo.Context) error {
+	s, err := bindSchedule(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	err = b.HandleCreateSchedule(s)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	golog.Info("Broker", "CreateSchedule", "ok", 0,
+		"id", s.Id,
+		"cron", s.Cron,
+		"bin_name", s.Request.BinName,
+		"task_type", s.Request.TaskType,
+		"next_time", s.NextTime,
+	)
+	return c.JSON(http.StatusOK, s.Id)
+}
+
+func (b *Broker) UpdateSchedule(c echo.Context) error {
+	s, err := bindSchedule(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	s.Id = c.Param("id")
+	err = b.HandleUpdateSchedule(s)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	golog.Info("Broker", "UpdateSchedule", "ok", 0,
+		"id", s.Id,
+		"cron", s.Cron,
+		"bin_name", s.Request.BinName,
+		"task_type", s.Request.TaskType,
+		"next_time", s.NextTime,
+	)
+	return c.JSON(http.StatusOK, s)
+}
+
+func (b *Broker) GetSchedule(c echo.Context) error {
+	s, err := b.HandleGetSchedule(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+func (b *Broker) ListSchedules(c echo.Context) error {
+	schedules, err := b.HandleListSchedules()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	return c.JSON(http.StatusOK, schedules)
+}
+
+func (b *Broker) DeleteSchedule(c echo.Context) error {
+	id := c.Param("id")
+	err := b.HandleDeleteSchedule(id)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	golog.Info("Broker", "DeleteSchedule", "ok", 0, "id", id)
+	return c.JSON(http.StatusOK, id)
+}
+
+func (b *Broker) CreateWorkflow(c echo.Context) error {
+	args := struct {
+		Tasks []struct {
+			Name      string   `json:"name"`
+			DependsOn []string `json:"depends_on"`
+			taskSpec
+		} `json:"tasks"`
+	}{}
+
+	err := c.Bind(&args)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	w := new(task.Workflow)
+	requests := make([]*task.TaskRequest, 0, len(args.Tasks))
+	for _, t := range args.Tasks {
+		request, err := t.request()
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err.Error())
+		}
+		w.Nodes = append(w.Nodes, task.WorkflowNode{Name: t.Name, DependsOn: t.DependsOn})
+		requests = append(requests, request)
+	}
+
+	err = b.HandleCreateWorkflow(w, requests)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	golog.Info("Broker", "CreateWorkflow", "ok", 0,
+		"id", w.Id,
+		"nodes", len(w.Nodes),
+	)
+	return c.JSON(http.StatusOK, w.Id)
+}
+
+func (b *Broker) GetWorkflow(c echo.Context) error {
+	w, err := b.HandleGetWorkflow(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	reply := struct {
+		Id      string              `json:"id"`
+		State   string              `json:"state"`
+		Summary map[string]int      `json:"summary"`
+		Nodes   []task.WorkflowNode `json:"nodes"`
+	}{w.Id, w.State(), w.Summary(), w.Nodes}
+	return c.JSON(http.StatusOK, reply)
+}
+
+func (b *Broker) CreateGroup(c echo.Context) error {
+	args := struct {
+		Tasks    []taskSpec `json:"tasks"`
+		Callback *taskSpec  `json:"callback"` //所有成员完成后提交
+	}{}
+
+	err := c.Bind(&args)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	requests := make([]*task.TaskRequest, 0, len(args.Tasks))
+	for i := range args.Tasks {
+		request, err := args.Tasks[i].request()
+		if err != nil {
+			return c.JSON(http.StatusForbidden, err.Error())
+		}
+		requests = append(requests, request)
+	}
+	callback, err := args.Callback.followUp()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+
+	g, err := b.HandleCreateGroup(requests, callback)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	golog.Info("Broker", "CreateGroup", "ok", 0,
+		"id", g.Id,
+		"members", len(g.Members),
+	)
+	return c.JSON(http.StatusOK, g.Id)
+}
+
+func (b *Broker) GetGroup(c echo.Context) error {
+	g, err := b.HandleGetGroup(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	reply := struct {
+		Id        string   `json:"id"`
+		State     string   `json:"state"`
+		Total     int      `json:"total"`
+		Completed int64    `json:"completed"`
+		Failed    int64    `json:"failed"`
+		Pending   int64    `json:"pending"`
+		Members   []string `json:"members"`
+	}{g.Id, g.State(), len(g.Members), g.Completed, g.Failed, g.Pending(), g.Members}
+	return c.JSON(http.StatusOK, reply)
+}
+
+func (b *Broker) GetLeader(c echo.Context) error {
+	leader, err := b.HandleGetLeader()
+	if err != nil {
+		return c.JSON(http.StatusForbidden, err.Error())
+	}
+	reply := struct {
+		BrokerId string `json:"broker_id"`
+		Leader   string `json:"leader"`
+		IsLeader bool   `json:"is_leader"`
+	}{b.id, leader, b.IsLeader()}
+	return c.JSON(http.StatusOK, reply)
+}
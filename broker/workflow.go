@@ -0,0 +1,183 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flike/golog"
+	"github.com/pborman/uuid"
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+)
+
+//创建工作流，requests[i]为w.Nodes[i]的任务请求，没有父节点的任务立即提交
+func (b *Broker) HandleCreateWorkflow(w *task.Workflow, requests []*task.TaskRequest) error {
+	if len(w.Nodes) != len(requests) {
+		return errors.ErrInvalidArgument
+	}
+	err := w.Validate()
+	if err != nil {
+		return err
+	}
+
+	w.Id = uuid.New()
+	for i := range w.Nodes {
+		request := requests[i]
+		request.Uuid = uuid.New()
+		request.Workflow = w.Id
+		request.WorkflowNode = w.Nodes[i].Name
+		request.UniqueKey = ""
+		//start_time为空时在提交时设置，子节点的ttl从父节点都成功后开始计算
+		err = b.checkRequest(request)
+		if err != nil {
+			return err
+		}
+		w.Nodes[i].Uuid = request.Uuid
+		w.Nodes[i].State = task.NodePending
+	}
+
+	err = b.store.SaveWorkflow(w)
+	if err != nil {
+		return err
+	}
+	//子节点的请求先保存，父节点都成功后再提交
+	for _, request := range requests {
+		err = b.store.SaveRequest(request)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range w.Nodes {
+		if len(w.Nodes[i].DependsOn) == 0 {
+			b.releaseWorkflowNode(w, &w.Nodes[i])
+		}
+	}
+	return nil
+}
+
+func (b *Broker) HandleGetWorkflow(id string) (*task.Workflow, error) {
+	if len(id) == 0 {
+		return nil, errors.ErrInvalidArgument
+	}
+	return b.store.GetWorkflow(id)
+}
+
+//工作流中的任务到达最终状态，成功时提交父节点都已成功的子节点，否则跳过所有后代节点
+func (b *Broker) advanceWorkflow(result *task.TaskResult) {
+	id, name := result.Workflow, result.WorkflowNode
+	state := task.NodeFailure
+	if result.IsSuccess == int64(1) {
+		state = task.NodeSuccess
+	} else if result.State == task.StateCancelled {
+		state = task.NodeCancelled
+	}
+
+	ok, err := b.store.SetWorkflowState(id, name, task.NodeRunning, state)
+	if err != nil {
+		golog.Error("Broker", "advanceWorkflow", err.Error(), 0,
+			"workflow", id, "node", name)
+		return
+	}
+	//已经处理过
+	if !ok {
+		return
+	}
+	w, err := b.store.GetWorkflow(id)
+	if err != nil {
+		golog.Error("Broker", "advanceWorkflow", err.Error(), 0, "workflow", id)
+		return
+	}
+	golog.Info("Broker", "advanceWorkflow", "node finished", 0,
+		"workflow", id, "node", name, "state", state)
+	for _, child := range w.Children(name) {
+		if state == task.NodeSuccess {
+			b.releaseWorkflowNode(w, child)
+		} else {
+			b.skipWorkflowNode(w, child)
+		}
+	}
+}
+
+//所有父节点都成功后提交节点，多个父节点同时完成时只提交一次
+func (b *Broker) releaseWorkflowNode(w *task.Workflow, node *task.WorkflowNode) {
+	for _, parent := range node.DependsOn {
+		if w.Node(parent).State != task.NodeSuccess {
+			return
+		}
+	}
+	ok, err := b.store.SetWorkflowState(w.Id, node.Name, task.NodePending, task.NodeRunning)
+	if err != nil || !ok {
+		return
+	}
+	node.State = task.NodeRunning
+
+	request, err := b.store.GetRequest(node.Uuid)
+	if err == nil {
+		err = b.HandleRequest(request)
+	}
+	if err != nil {
+		golog.Error("Broker", "releaseWorkflowNode", err.Error(), 0,
+			"workflow", w.Id, "node", node.Name, "key", fmt.Sprintf("t_%s", node.Uuid))
+		//提交失败按节点失败处理
+		if request == nil {
+			request = &task.TaskRequest{Uuid: node.Uuid, Workflow: w.Id, WorkflowNode: node.Name}
+		}
+		result := b.saveResult(request, task.StateFailure, err.Error())
+		b.advanceWorkflow(result)
+	}
+}
+
+//跳过节点及其所有后代节点
+func (b *Broker) skipWorkflowNode(w *task.Workflow, node *task.WorkflowNode) {
+	ok, err := b.store.SetWorkflowState(w.Id, node.Name, task.NodePending, task.NodeSkipped)
+	if err != nil || !ok {
+		return
+	}
+	node.State = task.NodeSkipped
+
+	request, err := b.store.GetRequest(node.Uuid)
+	if err == nil {
+		b.saveResult(request, task.StateSkipped, "skipped")
+		b.store.DeleteRequest(node.Uuid)
+	}
+	for _, child := range w.Children(node.Name) {
+		b.skipWorkflowNode(w, child)
+	}
+}
+
+//取消还在等待父节点的节点并跳过其所有后代节点，返回节点是否处于等待状态
+func (b *Broker) cancelWorkflowNode(r *task.TaskRequest) (bool, error) {
+	ok, err := b.store.SetWorkflowState(r.Workflow, r.WorkflowNode, task.NodePending, task.NodeCancelled)
+	if err != nil || !ok {
+		return false, err
+	}
+	b.setCancelledResult(r)
+	b.store.DeleteRequest(r.Uuid)
+
+	w, err := b.store.GetWorkflow(r.Workflow)
+	if err != nil {
+		golog.Error("Broker", "cancelWorkflowNode", err.Error(), 0, "workflow", r.Workflow)
+		return true, nil
+	}
+	for _, child := range w.Children(r.WorkflowNode) {
+		b.skipWorkflowNode(w, child)
+	}
+	return true, nil
+}
+
+//保存broker产生的失败结果
+func (b *Broker) saveResult(r *task.TaskRequest, state string, message string) *task.TaskResult {
+	result := &task.TaskResult{
+		TaskRequest: *r,
+		IsSuccess:   int64(0),
+		Result:      message,
+		State:       state,
+	}
+	err := b.store.SaveResult(result, time.Second*config.DefaultResultKeepTime)
+	if err != nil {
+		golog.Error("Broker", "saveResult", err.Error(), 0,
+			"key", fmt.Sprintf("t_%s", r.Uuid))
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/the-no/kingtask/task"
+)
+
+func TestWorkflowChildTTL(t *testing.T) {
+	b, m := newTestBroker(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	w := &task.Workflow{
+		Nodes: []task.WorkflowNode{
+			{Name: "a"},
+			{Name: "b", DependsOn: []string{"a"}},
+		},
+	}
+	requests := []*task.TaskRequest{
+		{BinName: "echo", TaskType: task.ScriptTask},
+		{BinName: "echo", TaskType: task.ScriptTask, TTL: 60},
+	}
+	err := b.HandleCreateWorkflow(w, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//父节点运行的时间超过子节点的ttl
+	m.Advance(time.Hour)
+	result := &task.TaskResult{TaskRequest: *requests[0], IsSuccess: 1, State: task.StateSuccess}
+	b.finishTask(result)
+
+	w, err = b.HandleGetWorkflow(w.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Node("b").State != task.NodeRunning {
+		t.Fatalf("node b state %s", w.Node("b").State)
+	}
+	request, err := b.store.GetRequest(w.Node("b").Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := m.Now().Unix()
+	if request.StartTime != now || request.ExpiresAt != now+60 {
+		t.Errorf("start time %d, expires at %d, now %d", request.StartTime, request.ExpiresAt, now)
+	}
+}
+
+func TestCancelPendingWorkflowNode(t *testing.T) {
+	b, _ := newTestBroker(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	w := &task.Workflow{
+		Nodes: []task.WorkflowNode{
+			{Name: "a"},
+			{Name: "b", DependsOn: []string{"a"}},
+			{Name: "c", DependsOn: []string{"b"}},
+		},
+	}
+	requests := make([]*task.TaskRequest, 0, len(w.Nodes))
+	for range w.Nodes {
+		requests = append(requests, &task.TaskRequest{BinName: "echo", TaskType: task.ScriptTask})
+	}
+	err := b.HandleCreateWorkflow(w, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.HandleCancelTask(w.Node("b").Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = b.HandleGetWorkflow(w.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]string{"a": task.NodeRunning, "b": task.NodeCancelled, "c": task.NodeSkipped}
+	for name, state := range states {
+		if w.Node(name).State != state {
+			t.Errorf("node %s state %s, want %s", name, w.Node(name).State, state)
+		}
+	}
+	reply, err := b.HandleTaskResult(w.Node("b").Uuid)
+	if err != nil || reply.State != task.StateCancelled {
+		t.Fatalf("result %+v, err=%v", reply, err)
+	}
+
+	//节点已取消，父节点成功后不再提交
+	result := &task.TaskResult{TaskRequest: *requests[0], IsSuccess: 1, State: task.StateSuccess}
+	b.finishTask(result)
+	if count, _ := b.store.UndoCount(task.DefaultQueue); count != 1 {
+		t.Errorf("undo count=%d", count)
+	}
+}
@@ -7,20 +7,41 @@ import (
 )
 
 type BrokerConfig struct {
-	Addr      string `yaml:"addr"`
-	RedisAddr string `yaml:"redis"`
-	LogPath   string `yaml:"log_path"`
-	LogLevel  string `yaml:"log_level"`
+	Addr              string `yaml:"addr"`
+	RedisAddr         string `yaml:"redis"`
+	LogPath           string `yaml:"log_path"`
+	LogLevel          string `yaml:"log_level"`
+	IdempotencyWindow int64  `yaml:"idempotency_window"`
+	CalendarPath      string `yaml:"calendar_path"`
+	BrokerId          string `yaml:"broker_id"`
+	LeaderLease       int64  `yaml:"leader_lease"`
 }
 
 type WorkerConfig struct {
-	RedisAddr      string `yaml:"redis"`
-	LogPath        string `yaml:"log_path"`
-	LogLevel       string `yaml:"log_level"`
-	BinPath        string `yaml:"bin_path"`
-	Peroid         int64  `yaml:"peroid"`
-	ResultKeepTime int64  `yaml:"result_keep_time"`
-	TaskRunTime    int64  `yaml:"task_run_time"`
+	WorkerId       string   `yaml:"worker_id"`
+	RedisAddr      string   `yaml:"redis"`
+	LogPath        string   `yaml:"log_path"`
+	LogLevel       string   `yaml:"log_level"`
+	BinPath        string   `yaml:"bin_path"`
+	Peroid         int64    `yaml:"peroid"`
+	ResultKeepTime int64    `yaml:"result_keep_time"`
+	TaskRunTime    int64    `yaml:"task_run_time"`
+	LeaseTime      int64    `yaml:"lease_time"`
+	StarveInterval int64    `yaml:"starve_interval"`
+	Queues         []string `yaml:"queues"`
+	//排除日历目录，应和broker的calendar_path相同
+	CalendarPath string `yaml:"calendar_path"`
+
+	//所有worker共同遵守的限流规则，所有worker应使用相同的配置
+	RateLimits []RateLimit `yaml:"rate_limits"`
+}
+
+//period秒内最多开始执行limit个匹配key的任务，超过的任务推迟到下一个周期，
+//key为"bin:可执行文件名"、"host:RPC地址的主机"或"key:任务的rate_key"
+type RateLimit struct {
+	Key    string `yaml:"key"`
+	Limit  int64  `yaml:"limit"`
+	Period int64  `yaml:"period"`
 }
 
 func ParseBrokerConfigFile(fileName string) (*BrokerConfig, error) {
@@ -1,16 +1,38 @@
 package config
 
 const (
-	DefaultRedisDB       = 0
-	TaskRequestItemCount = 6
-	RequestUuidSet       = "request_uuid_set"
-	FailResultUuidSet    = "fail_result_uuid_set"
-	TimeFormat           = "2006-01-02"
-	FailTaskKey          = "fail_task_count:%s"
-	SuccessTaskKey       = "success_task_count:%s"
-	TypeRequestTask      = 1
-	TypeGetTaskResult    = 2
-	TypeCloseConn        = 3
+	DefaultRedisDB        = 0
+	RequestUuidSet        = "request_uuid_set"
+	RequestUuidListPrefix = "request_uuid_list:"
+	OrderKeyLockPrefix    = "order_key_lock:"
+	OrderKeyListPrefix    = "order_key_list:"
+	UniqueKeyPrefix       = "unique_key:"
+	DefaultUniqueKeyTime  = 60 * 60 * 24
+	CancelTaskKey         = "cancel_task:%s"
+	CancelTaskKeepTime    = 60 * 60 * 24
+	DefaultResultKeepTime = 60 * 60 * 24
+	RateLimitKey          = "rate_limit:%s:%d"
+	ConcurrencyKey        = "concurrency:%s"
+	ConcurrencyWaitPrefix = "concurrency_wait:"
+	ConcurrencyWaitHash   = "concurrency_wait_limit"
+	ScheduleIdZset        = "schedule_id_zset"
+	QueueNameSet          = "queue_name_set"
+	DelayUuidZset         = "delay_uuid_zset"
+	DelaySeqPrefix        = "delay_seq:"
+	WorkerIdSet           = "worker_id_set"
+	ProcessingUuidZset    = "processing_uuid_zset:%s"
+	DefaultLeaseTime      = 60
+	FailResultUuidSet     = "fail_result_uuid_set"
+	FinishResultUuidSet   = "finish_result_uuid_set"
+	TimeFormat            = "2006-01-02"
+	FailTaskKey           = "fail_task_count:%s"
+	SuccessTaskKey        = "success_task_count:%s"
+	ExpiredTaskKey        = "expired_task_count:%s"
+	BrokerLeaderKey       = "broker_leader"
+	DefaultLeaderLease    = 10
+	TypeRequestTask       = 1
+	TypeGetTaskResult     = 2
+	TypeCloseConn         = 3
 )
 
 const (
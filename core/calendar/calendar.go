@@ -0,0 +1,233 @@
+//execution windows and exclusion calendars
+package calendar
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/the-no/kingtask/core/errors"
+)
+
+const DateFormat = "2006-01-02"
+
+//超过这个天数仍找不到允许执行的时刻，认为永远不会执行
+const maxSearchDays = 366 * 2
+
+//排除日历，例如法定节假日，这些日期内不执行任务
+type Calendar struct {
+	Name  string
+	dates map[string]bool
+}
+
+//每行一个YYYY-MM-DD格式的日期，忽略空行和#开头的注释
+func LoadFile(name string, path string) (*Calendar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Calendar{Name: name, dates: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		date, err := time.Parse(DateFormat, line)
+		if err != nil {
+			return nil, err
+		}
+		c.dates[date.Format(DateFormat)] = true
+	}
+	return c, scanner.Err()
+}
+
+//加载目录下的所有日历文件，文件名去掉扩展名即为日历名
+func LoadDir(dir string) (map[string]*Calendar, error) {
+	calendars := make(map[string]*Calendar)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		c, err := LoadFile(name, filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		calendars[name] = c
+	}
+	return calendars, nil
+}
+
+//t所在的日期（按t的时区）是否被排除
+func (c *Calendar) Excluded(t time.Time) bool {
+	return c.dates[t.Format(DateFormat)]
+}
+
+//一天内允许执行的时间段[Start, End)，单位为分钟，Start大于End表示跨过午夜
+type Window struct {
+	Start int
+	End   int
+}
+
+//空格分隔的多个时间段，例如"01:00-05:00 22:00-24:00"
+func ParseWindows(s string) ([]Window, error) {
+	windows := make([]Window, 0)
+	for _, item := range strings.Fields(s) {
+		vec := strings.Split(item, "-")
+		if len(vec) != 2 {
+			return nil, errors.ErrInvalidWindow
+		}
+		start, err := parseClock(vec[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(vec[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, errors.ErrInvalidWindow
+		}
+		windows = append(windows, Window{start, end})
+	}
+	return windows, nil
+}
+
+//HH:MM格式，允许24:00表示一天结束
+func parseClock(s string) (int, error) {
+	vec := strings.Split(s, ":")
+	if len(vec) != 2 {
+		return 0, errors.ErrInvalidWindow
+	}
+	hour, err := strconv.Atoi(vec[0])
+	if err != nil {
+		return 0, errors.ErrInvalidWindow
+	}
+	minute, err := strconv.Atoi(vec[1])
+	if err != nil || minute < 0 || 59 < minute {
+		return 0, errors.ErrInvalidWindow
+	}
+	clock := hour*60 + minute
+	if hour < 0 || 24*60 < clock {
+		return 0, errors.ErrInvalidWindow
+	}
+	return clock, nil
+}
+
+//为空表示服务器本地时区
+func LoadLocation(name string) (*time.Location, error) {
+	if len(name) == 0 {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.ErrInvalidTimezone
+	}
+	return loc, nil
+}
+
+//任务允许执行的时刻：Location时区下Windows内且不在Calendars排除的日期，
+//没有Windows表示全天都允许
+type Rule struct {
+	Location  *time.Location
+	Windows   []Window
+	Calendars []*Calendar
+}
+
+//按时区、空格分隔的执行时间段和排除日历名创建规则，三者都为空时返回nil，
+//日历名必须在calendars中
+func NewRule(timezone string, windows string, names string, calendars map[string]*Calendar) (*Rule, error) {
+	if len(timezone) == 0 && len(windows) == 0 && len(names) == 0 {
+		return nil, nil
+	}
+	r := new(Rule)
+	var err error
+	r.Location, err = LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	r.Windows, err = ParseWindows(windows)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Fields(names) {
+		c, ok := calendars[name]
+		if !ok {
+			return nil, errors.ErrCalendarNotExist
+		}
+		r.Calendars = append(r.Calendars, c)
+	}
+	return r, nil
+}
+
+func (r *Rule) Allowed(t time.Time) bool {
+	return r.Next(t).Equal(t)
+}
+
+//不早于t的最早允许执行的时刻，永远不允许执行时返回零值
+func (r *Rule) Next(t time.Time) time.Time {
+	loc := r.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	segments := r.segments()
+	for i := 0; i < maxSearchDays; i++ {
+		if !r.excluded(t) {
+			clock := t.Hour()*60 + t.Minute()
+			for _, seg := range segments {
+				if seg.Start <= clock && clock < seg.End {
+					return t
+				}
+			}
+			//segments按开始时刻排序
+			for _, seg := range segments {
+				if clock < seg.Start {
+					return time.Date(t.Year(), t.Month(), t.Day(), seg.Start/60, seg.Start%60, 0, 0, loc)
+				}
+			}
+		}
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+	}
+	return time.Time{}
+}
+
+func (r *Rule) excluded(t time.Time) bool {
+	for _, c := range r.Calendars {
+		if c.Excluded(t) {
+			return true
+		}
+	}
+	return false
+}
+
+//将跨过午夜的时间段拆成两段，按开始时刻排序
+func (r *Rule) segments() []Window {
+	if len(r.Windows) == 0 {
+		return []Window{{0, 24 * 60}}
+	}
+	segments := make([]Window, 0, len(r.Windows)+1)
+	for _, w := range r.Windows {
+		if w.Start < w.End {
+			segments = append(segments, w)
+			continue
+		}
+		segments = append(segments, Window{0, w.End}, Window{w.Start, 24 * 60})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start < segments[j].Start
+	})
+	return segments
+}
@@ -0,0 +1,128 @@
+package calendar
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseWindows(t *testing.T) {
+	windows, err := ParseWindows("01:00-05:00 22:30-02:00 23:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Window{{60, 300}, {1350, 120}, {1380, 1440}}
+	if len(windows) != len(want) {
+		t.Fatalf("windows %v", windows)
+	}
+	for i := range want {
+		if windows[i] != want[i] {
+			t.Errorf("window %d=%v, want %v", i, windows[i], want[i])
+		}
+	}
+	for _, s := range []string{"01:00", "01:00-01:00", "25:00-26:00", "01:60-02:00", "a-b", "24:01-01:00"} {
+		if _, err := ParseWindows(s); err == nil {
+			t.Errorf("parse %q should fail", s)
+		}
+	}
+}
+
+func TestRuleNext(t *testing.T) {
+	berlin, err := LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+	windows, _ := ParseWindows("01:00-05:00")
+	holidays := &Calendar{Name: "holidays", dates: map[string]bool{"2015-12-25": true}}
+	r := &Rule{Location: berlin, Windows: windows, Calendars: []*Calendar{holidays}}
+
+	cases := []struct {
+		t    time.Time
+		want time.Time
+	}{
+		//窗口内
+		{time.Date(2015, 12, 23, 2, 30, 0, 0, berlin), time.Date(2015, 12, 23, 2, 30, 0, 0, berlin)},
+		//窗口之前
+		{time.Date(2015, 12, 23, 0, 10, 0, 0, berlin), time.Date(2015, 12, 23, 1, 0, 0, 0, berlin)},
+		//窗口之后，顺延到第二天
+		{time.Date(2015, 12, 23, 5, 0, 0, 0, berlin), time.Date(2015, 12, 24, 1, 0, 0, 0, berlin)},
+		//跳过节假日
+		{time.Date(2015, 12, 24, 12, 0, 0, 0, berlin), time.Date(2015, 12, 26, 1, 0, 0, 0, berlin)},
+		//其他时区的时刻按Berlin时区计算
+		{time.Date(2015, 12, 23, 0, 30, 0, 0, time.UTC), time.Date(2015, 12, 23, 1, 30, 0, 0, berlin)},
+	}
+	for _, c := range cases {
+		if got := r.Next(c.t); !got.Equal(c.want) {
+			t.Errorf("next(%s)=%s, want %s", c.t, got, c.want)
+		}
+	}
+	if r.Allowed(time.Date(2015, 12, 25, 2, 0, 0, 0, berlin)) {
+		t.Errorf("holiday should not be allowed")
+	}
+}
+
+func TestRuleOvernightWindow(t *testing.T) {
+	windows, _ := ParseWindows("22:00-02:00")
+	r := &Rule{Location: time.UTC, Windows: windows}
+	if !r.Allowed(time.Date(2015, 12, 23, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("23:00 should be allowed")
+	}
+	if !r.Allowed(time.Date(2015, 12, 23, 1, 59, 0, 0, time.UTC)) {
+		t.Errorf("01:59 should be allowed")
+	}
+	next := r.Next(time.Date(2015, 12, 23, 2, 0, 0, 0, time.UTC))
+	if want := time.Date(2015, 12, 23, 22, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("next=%s, want %s", next, want)
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	if r, err := NewRule("", "", "", nil); r != nil || err != nil {
+		t.Errorf("empty rule %v, err=%v", r, err)
+	}
+	holidays := &Calendar{Name: "holidays", dates: map[string]bool{"2015-12-25": true}}
+	calendars := map[string]*Calendar{"holidays": holidays}
+	r, err := NewRule("UTC", "01:00-05:00", "holidays", calendars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Windows) != 1 || len(r.Calendars) != 1 || r.Location.String() != "UTC" {
+		t.Errorf("rule %+v", r)
+	}
+	if _, err := NewRule("", "", "holidays unknown", calendars); err == nil {
+		t.Errorf("unknown calendar should fail")
+	}
+	if _, err := NewRule("", "01:00", "", nil); err == nil {
+		t.Errorf("invalid window should fail")
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := "#德国法定节假日\n2015-12-25\n\n2015-12-26\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "holidays-de.txt"), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calendars, err := LoadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := calendars["holidays-de"]
+	if !ok {
+		t.Fatalf("calendars %v", calendars)
+	}
+	if !c.Excluded(time.Date(2015, 12, 26, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("2015-12-26 should be excluded")
+	}
+	if c.Excluded(time.Date(2015, 12, 27, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("2015-12-27 should not be excluded")
+	}
+}
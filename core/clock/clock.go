@@ -0,0 +1,154 @@
+//时钟抽象，定时器和broker的调度通过Clock获取时间，
+//测试中使用Manual时钟可以瞬间推进数小时而不需要真实等待
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+//系统时钟
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{t: time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTicker) Stop() {
+	t.t.Stop()
+}
+
+//手动推进的时钟，只有调用Advance时时间才会前进
+type Manual struct {
+	sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+//等待中的Sleep或Ticker
+type waiter struct {
+	at time.Time
+	//为0表示Sleep，只触发一次
+	period time.Duration
+	c      chan time.Time
+}
+
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now}
+}
+
+func (m *Manual) Now() time.Time {
+	m.Lock()
+	defer m.Unlock()
+	return m.now
+}
+
+//阻塞到其他goroutine把时间推进d
+func (m *Manual) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	m.Lock()
+	w := &waiter{at: m.now.Add(d), c: make(chan time.Time, 1)}
+	m.waiters = append(m.waiters, w)
+	m.Unlock()
+	<-w.c
+}
+
+//与time.Ticker相同，接收方处理不及时的tick会被丢弃
+func (m *Manual) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	m.Lock()
+	defer m.Unlock()
+	w := &waiter{at: m.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	m.waiters = append(m.waiters, w)
+	return &manualTicker{m: m, w: w}
+}
+
+//把时间推进d，唤醒到期的Sleep，并向到期的Ticker发送当前时间
+func (m *Manual) Advance(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.now = m.now.Add(d)
+	waiters := m.waiters[:0]
+	for _, w := range m.waiters {
+		if w.at.After(m.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		select {
+		case w.c <- m.now:
+		default:
+		}
+		if w.period == 0 {
+			continue
+		}
+		for !w.at.After(m.now) {
+			w.at = w.at.Add(w.period)
+		}
+		waiters = append(waiters, w)
+	}
+	m.waiters = waiters
+}
+
+//等待中的Sleep和Ticker的个数，测试中用于确认其他goroutine已经开始等待
+func (m *Manual) Waiters() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.waiters)
+}
+
+func (m *Manual) remove(w *waiter) {
+	m.Lock()
+	defer m.Unlock()
+	for i := range m.waiters {
+		if m.waiters[i] == w {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type manualTicker struct {
+	m *Manual
+	w *waiter
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t *manualTicker) Stop() {
+	t.m.remove(t.w)
+}
@@ -0,0 +1,80 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualSleep(t *testing.T) {
+	m := NewManual(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		m.Sleep(time.Hour)
+		close(done)
+	}()
+	for m.Waiters() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	m.Advance(time.Hour - time.Second)
+	select {
+	case <-done:
+		t.Fatal("sleep returned before deadline")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	m.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sleep not woken")
+	}
+	if m.Waiters() != 0 {
+		t.Fatalf("waiters %d", m.Waiters())
+	}
+	if !m.Now().Equal(time.Unix(3600, 0)) {
+		t.Fatalf("now %v", m.Now())
+	}
+}
+
+func TestManualTicker(t *testing.T) {
+	m := NewManual(time.Unix(0, 0))
+	tick := m.NewTicker(time.Minute)
+
+	m.Advance(30 * time.Second)
+	select {
+	case <-tick.C():
+		t.Fatal("tick before period")
+	default:
+	}
+
+	m.Advance(30 * time.Second)
+	select {
+	case now := <-tick.C():
+		if now.Unix() != 60 {
+			t.Fatalf("tick time %v", now)
+		}
+	default:
+		t.Fatal("no tick")
+	}
+
+	//未接收的tick被丢弃，只保留一个
+	m.Advance(time.Hour)
+	<-tick.C()
+	select {
+	case <-tick.C():
+		t.Fatal("tick not dropped")
+	default:
+	}
+
+	tick.Stop()
+	if m.Waiters() != 0 {
+		t.Fatalf("waiters %d", m.Waiters())
+	}
+	m.Advance(time.Hour)
+	select {
+	case <-tick.C():
+		t.Fatal("tick after stop")
+	default:
+	}
+}
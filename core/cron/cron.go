@@ -0,0 +1,191 @@
+//cron expression
+//5个字段：分 时 日 月 周，6个字段：秒 分 时 日 月 周
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/the-no/kingtask/core/errors"
+)
+
+type field struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	seconds = field{0, 59, nil}
+	minutes = field{0, 59, nil}
+	hours   = field{0, 23, nil}
+	doms    = field{1, 31, nil}
+	months  = field{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	//7和0都表示周日
+	dows = field{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//超过这个年限仍找不到触发时刻，认为表达式永远不会触发，例如2月30日
+const maxSearchYears = 5
+
+//每个字段用位图表示允许的取值
+type Schedule struct {
+	second, minute, hour, dom, month, dow uint64
+	//日和周都不是*时，满足其中一个即可，和标准cron一致
+	domStar, dowStar bool
+}
+
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := macros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, errors.ErrInvalidCron
+	}
+
+	var err error
+	s := new(Schedule)
+	parsers := []struct {
+		bits *uint64
+		f    field
+	}{
+		{&s.second, seconds},
+		{&s.minute, minutes},
+		{&s.hour, hours},
+		{&s.dom, doms},
+		{&s.month, months},
+		{&s.dow, dows},
+	}
+	for i, p := range parsers {
+		*p.bits, err = parseField(fields[i], p.f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[3] == "*" || fields[3] == "?"
+	s.dowStar = fields[5] == "*" || fields[5] == "?"
+	return s, nil
+}
+
+//逗号分隔的列表，每一项为*、n或n-m，可带/step
+func parseField(expr string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(expr, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.ErrInvalidCron
+			}
+			step = n
+			item = item[:i]
+		}
+
+		var start, end int
+		var err error
+		switch {
+		case item == "*" || item == "?":
+			start, end = f.min, f.max
+		case strings.Contains(item, "-"):
+			vec := strings.SplitN(item, "-", 2)
+			if start, err = f.value(vec[0]); err != nil {
+				return 0, err
+			}
+			if end, err = f.value(vec[1]); err != nil {
+				return 0, err
+			}
+		default:
+			if start, err = f.value(item); err != nil {
+				return 0, err
+			}
+			end = start
+			//n/step表示从n开始到最大值
+			if step != 1 {
+				end = f.max
+			}
+		}
+		if end < start {
+			return 0, errors.ErrInvalidCron
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || f.max < v {
+		return 0, errors.ErrInvalidCron
+	}
+	return v, nil
+}
+
+//t之后（不含t）的下一个触发时刻，使用t所在的时区，永远不会触发时返回零值
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Add(time.Second - time.Duration(t.Nanosecond())*time.Nanosecond)
+	loc := t.Location()
+	yearLimit := t.Year() + maxSearchYears
+
+	for t.Year() <= yearLimit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if s.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
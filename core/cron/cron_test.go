@@ -0,0 +1,82 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	base := time.Date(2015, 10, 30, 10, 20, 30, 500, time.UTC)
+	cases := []struct {
+		spec string
+		want string
+	}{
+		{"* * * * *", "2015-10-30 10:21:00"},
+		{"* * * * * *", "2015-10-30 10:20:31"},
+		{"*/15 * * * *", "2015-10-30 10:30:00"},
+		{"0 2 * * *", "2015-10-31 02:00:00"},
+		{"30 1-3 * * *", "2015-10-31 01:30:00"},
+		{"0 0 1 * *", "2015-11-01 00:00:00"},
+		{"0 9 * * mon-fri", "2015-11-02 09:00:00"},
+		{"0 9 * * 7", "2015-11-01 09:00:00"},
+		{"0 0 29 feb *", "2016-02-29 00:00:00"},
+		{"0 0 13 * 5", "2015-11-06 00:00:00"},
+		{"10,40 10 30 oct *", "2015-10-30 10:40:00"},
+		{"5/20 * * * * *", "2015-10-30 10:20:45"},
+		{"@hourly", "2015-10-30 11:00:00"},
+		{"@daily", "2015-10-31 00:00:00"},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.spec)
+		if err != nil {
+			t.Errorf("parse %q: %v", c.spec, err)
+			continue
+		}
+		got := s.Next(base).Format("2006-01-02 15:04:05")
+		if got != c.want {
+			t.Errorf("%q next=%s, want %s", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestNextLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	s, err := Parse("0 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := s.Next(time.Date(2015, 10, 30, 10, 0, 0, 0, loc))
+	if want := time.Date(2015, 10, 31, 2, 0, 0, 0, loc); !next.Equal(want) {
+		t.Errorf("next=%s, want %s", next, want)
+	}
+}
+
+func TestNextNever(t *testing.T) {
+	s, err := Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Errorf("next=%s, want zero", next)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("parse %q should fail", spec)
+		}
+	}
+}
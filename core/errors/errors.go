@@ -9,11 +9,69 @@ func NewError(msg string) error {
 }
 
 var (
-	ErrMessageType     = errors.New("message type error")
-	ErrInvalidArgument = errors.New("invalid argument")
-	ErrTryMaxTimes     = errors.New("retry task max time")
-	ErrFileNotExist    = errors.New("file not exist")
-	ErrBadConn         = errors.New("bad net connection")
-	ErrResultNotExist  = errors.New("result not exist")
-	ErrExecTimeout     = errors.New("exec time out")
+	ErrMessageType        = errors.New("message type error")
+	ErrInvalidArgument    = errors.New("invalid argument")
+	ErrTryMaxTimes        = errors.New("retry task max time")
+	ErrFileNotExist       = errors.New("file not exist")
+	ErrBadConn            = errors.New("bad net connection")
+	ErrResultNotExist     = errors.New("result not exist")
+	ErrRequestNotExist    = errors.New("request not exist")
+	ErrQueueEmpty         = errors.New("queue empty")
+	ErrExecTimeout        = errors.New("exec time out")
+	ErrTaskFinished       = errors.New("task already finished")
+	ErrTaskCancelled      = errors.New("task cancelled")
+	ErrInvalidCron        = errors.New("invalid cron expression")
+	ErrScheduleNotExist   = errors.New("schedule not exist")
+	ErrInvalidWindow      = errors.New("invalid time window")
+	ErrInvalidTimezone    = errors.New("invalid timezone")
+	ErrCalendarNotExist   = errors.New("calendar not exist")
+	ErrInvalidRetryPolicy = errors.New("invalid retry policy")
+	ErrInvalidRetryOn     = errors.New("invalid retry_on rule")
+	ErrInvalidWorkflow    = errors.New("invalid workflow")
+	ErrWorkflowNotExist   = errors.New("workflow not exist")
+	ErrInvalidGroup       = errors.New("invalid group")
+	ErrGroupNotExist      = errors.New("group not exist")
+	ErrInvalidRateLimit   = errors.New("invalid rate limit")
+	ErrInvalidConcurrency = errors.New("invalid concurrency limit")
+	ErrTaskExpired        = errors.New("task expired")
+	ErrCodecVersion       = errors.New("unsupported codec version")
 )
+
+//任务失败的分类，用于决定是否重试
+const (
+	ClassTimeout    = "timeout"
+	ClassNotFound   = "not_found"
+	ClassExitCode   = "exit_code"
+	ClassHttpStatus = "http_status"
+	ClassTransport  = "transport"
+	ClassUnknown    = "unknown"
+)
+
+//带分类的任务执行错误
+type TaskError struct {
+	Class string
+	Code  int //exit_code的退出码或http_status的状态码
+	Msg   string
+}
+
+func NewTaskError(class string, code int, msg string) error {
+	return &TaskError{Class: class, Code: code, Msg: msg}
+}
+
+func (e *TaskError) Error() string {
+	return e.Msg
+}
+
+//返回任务执行错误的分类和码，未分类的错误为unknown
+func Classify(err error) (string, int) {
+	switch err {
+	case ErrExecTimeout:
+		return ClassTimeout, 0
+	case ErrFileNotExist:
+		return ClassNotFound, 0
+	}
+	if e, ok := err.(*TaskError); ok {
+		return e.Class, e.Code
+	}
+	return ClassUnknown, 0
+}
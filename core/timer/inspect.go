@@ -0,0 +1,104 @@
+package timer
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+//等待触发的节点和距离触发的时长
+type Pending struct {
+	Node *Node
+	Due  time.Duration
+}
+
+//快照中的节点，due为生成快照时距离触发的纳秒数
+type snapshotNode struct {
+	Name string `json:"name"`
+	Due  int64  `json:"due"`
+}
+
+//各层时间轮中等待触发的节点个数，下标0为near，1到4依次为t[0]到t[3]
+func (t *Timer) LevelCounts() [5]int {
+	var counts [5]int
+	t.Lock()
+	defer t.Unlock()
+	for i := 0; i < TIME_NEAR; i++ {
+		counts[0] += t.near[i].Len()
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < TIME_LEVEL; j++ {
+			counts[i+1] += t.t[i][j].Len()
+		}
+	}
+	return counts
+}
+
+//等待触发的节点总数
+func (t *Timer) Len() int {
+	total := 0
+	for _, count := range t.LevelCounts() {
+		total += count
+	}
+	return total
+}
+
+//按触发先后返回所有等待触发的节点
+func (t *Timer) Pending() []Pending {
+	pending := make([]Pending, 0)
+	t.Lock()
+	collect := func(l *list.List) {
+		for e := l.Front(); e != nil; e = e.Next() {
+			node := e.Value.(*Node)
+			pending = append(pending, Pending{
+				Node: node,
+				Due:  time.Duration(node.expire-t.time) * t.tick,
+			})
+		}
+	}
+	for i := 0; i < TIME_NEAR; i++ {
+		collect(t.near[i])
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < TIME_LEVEL; j++ {
+			collect(t.t[i][j])
+		}
+	}
+	t.Unlock()
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Due < pending[j].Due
+	})
+	return pending
+}
+
+//序列化所有有名字的等待节点，没有名字的节点无法恢复回调，不包含在快照中
+func (t *Timer) Snapshot() ([]byte, error) {
+	nodes := make([]snapshotNode, 0)
+	for _, p := range t.Pending() {
+		if len(p.Node.name) == 0 {
+			continue
+		}
+		nodes = append(nodes, snapshotNode{Name: p.Node.name, Due: int64(p.Due)})
+	}
+	return json.Marshal(nodes)
+}
+
+//按快照重新加入节点，触发时长从恢复时开始计算，
+//resolve根据名字返回回调，返回nil的节点被忽略，返回恢复的节点
+func (t *Timer) Restore(data []byte, resolve func(name string) Func) ([]*Node, error) {
+	var nodes []snapshotNode
+	err := json.Unmarshal(data, &nodes)
+	if err != nil {
+		return nil, err
+	}
+	restored := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		fn := resolve(node.Name)
+		if fn == nil {
+			continue
+		}
+		restored = append(restored, t.AfterFuncName(node.Name, time.Duration(node.Due), fn))
+	}
+	return restored, nil
+}
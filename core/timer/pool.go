@@ -0,0 +1,194 @@
+package timer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/flike/golog"
+)
+
+//队列已满时的处理策略
+type Policy int
+
+const (
+	//阻塞时间轮直到队列有空位，到期的回调会整体推迟
+	PolicyBlock Policy = iota
+	//丢弃回调，记录日志并通过ErrorHandler报告ErrDropped
+	PolicyDrop
+	//放入不限长度的溢出队列，队列有空位时再依次放回
+	PolicySpill
+)
+
+var (
+	ErrDropped = errors.New("timer dispatch queue full, callback dropped")
+	//Timer停止时还在排队的回调不再执行
+	ErrDiscarded = errors.New("timer stopped, queued callback discarded")
+)
+
+//回调执行池的状态
+type DispatchStats struct {
+	Workers    int    `json:"workers"`
+	Queued     int    `json:"queued"`  //等待执行的回调个数
+	Spilled    int    `json:"spilled"` //溢出队列中的回调个数
+	Running    int64  `json:"running"`
+	Dispatched uint64 `json:"dispatched"` //已开始执行的回调个数
+	Dropped    uint64 `json:"dropped"`
+}
+
+type pool struct {
+	workers int
+	policy  Policy
+	queue   chan *Node
+	quit    chan struct{}
+
+	running    int64
+	dispatched uint64
+	dropped    uint64
+
+	spillLock sync.Mutex
+	spill     []*Node
+	//溢出队列非空时通知
+	spillCh chan struct{}
+
+	startOnce sync.Once
+}
+
+func newPool(workers int, queueSize int, policy Policy, quit chan struct{}) *pool {
+	p := new(pool)
+	p.workers = workers
+	p.policy = policy
+	p.queue = make(chan *Node, queueSize)
+	p.quit = quit
+	p.spillCh = make(chan struct{}, 1)
+	return p
+}
+
+//由Timer.Start启动执行回调的goroutine，多次调用只启动一次
+func (p *pool) start() {
+	p.startOnce.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+		if p.policy == PolicySpill {
+			go p.drainSpill()
+		}
+	})
+}
+
+//Timer停止后报告所有还在排队的回调
+func (p *pool) discard() {
+	for {
+		select {
+		case n := <-p.queue:
+			p.report(n, ErrDiscarded)
+		default:
+			p.spillLock.Lock()
+			spill := p.spill
+			p.spill = nil
+			p.spillLock.Unlock()
+			for _, n := range spill {
+				p.report(n, ErrDiscarded)
+			}
+			return
+		}
+	}
+}
+
+//没有执行的回调总是记录日志，并交给ErrorHandler
+func (p *pool) report(n *Node, err error) {
+	golog.Warn("Timer", "dispatch", err.Error(), 0, "node", n.String(), "name", n.name)
+	n.timer.reportError(n, err)
+}
+
+func (p *pool) work() {
+	for {
+		select {
+		case n := <-p.queue:
+			atomic.AddInt64(&p.running, 1)
+			atomic.AddUint64(&p.dispatched, 1)
+			n.RunFunc()
+			atomic.AddInt64(&p.running, -1)
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *pool) submit(n *Node) {
+	switch p.policy {
+	case PolicyDrop:
+		select {
+		case p.queue <- n:
+		default:
+			atomic.AddUint64(&p.dropped, 1)
+			p.report(n, ErrDropped)
+		}
+	case PolicySpill:
+		//溢出队列非空时也放入溢出队列，保持到期顺序
+		p.spillLock.Lock()
+		if len(p.spill) == 0 {
+			select {
+			case p.queue <- n:
+				p.spillLock.Unlock()
+				return
+			default:
+			}
+		}
+		p.spill = append(p.spill, n)
+		p.spillLock.Unlock()
+		select {
+		case p.spillCh <- struct{}{}:
+		default:
+		}
+	default:
+		select {
+		case p.queue <- n:
+		case <-p.quit:
+			p.report(n, ErrDiscarded)
+		}
+	}
+}
+
+//将溢出队列中的回调依次放回执行队列
+func (p *pool) drainSpill() {
+	for {
+		select {
+		case <-p.spillCh:
+		case <-p.quit:
+			return
+		}
+		for {
+			p.spillLock.Lock()
+			if len(p.spill) == 0 {
+				p.spillLock.Unlock()
+				break
+			}
+			//取出后不再计入溢出队列
+			n := p.spill[0]
+			p.spill[0] = nil
+			p.spill = p.spill[1:]
+			p.spillLock.Unlock()
+			select {
+			case p.queue <- n:
+			case <-p.quit:
+				p.report(n, ErrDiscarded)
+				return
+			}
+		}
+	}
+}
+
+func (p *pool) stats() DispatchStats {
+	p.spillLock.Lock()
+	spilled := len(p.spill)
+	p.spillLock.Unlock()
+	return DispatchStats{
+		Workers:    p.workers,
+		Queued:     len(p.queue),
+		Spilled:    spilled,
+		Running:    atomic.LoadInt64(&p.running),
+		Dispatched: atomic.LoadUint64(&p.dispatched),
+		Dropped:    atomic.LoadUint64(&p.dropped),
+	}
+}
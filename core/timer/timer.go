@@ -4,10 +4,13 @@ package timer
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"reflect"
 	"sync"
 	"time"
+
+	"github.com/the-no/kingtask/core/clock"
 )
 
 const (
@@ -19,19 +22,36 @@ const (
 	TIME_LEVEL_MASK  = 63
 )
 
+//节点到期时执行的回调，ctx在Timer停止时取消
+type Func func(ctx context.Context) error
+
+//回调返回错误或panic时调用
+type ErrorHandler func(n *Node, err error)
+
 type Timer struct {
 	near [TIME_NEAR]*list.List
 	t    [4][TIME_LEVEL]*list.List
 	sync.Mutex
-	time uint32
-	tick time.Duration
-	quit chan struct{}
+	time    uint32
+	tick    time.Duration
+	quit    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	onError ErrorHandler
+	//为nil时每个到期的回调启动一个goroutine
+	pool  *pool
+	clock clock.Clock
 }
 
 type Node struct {
 	expire uint32
-	fn     interface{}
-	arg    interface{}
+	fn     Func
+	timer  *Timer
+	//快照中用于恢复回调的名字
+	name string
+	//节点所在的链表和元素，用于O(1)删除，已触发或已停止时为nil
+	list *list.List
+	elem *list.Element
 }
 
 func (n *Node) String() string {
@@ -39,10 +59,17 @@ func (n *Node) String() string {
 }
 
 func New(d time.Duration) *Timer {
+	return NewWithClock(d, clock.Real)
+}
+
+//使用指定的时钟驱动时间轮，测试中使用clock.Manual
+func NewWithClock(d time.Duration, c clock.Clock) *Timer {
 	t := new(Timer)
 	t.time = 0
 	t.tick = d
 	t.quit = make(chan struct{})
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.clock = c
 
 	var i, j int
 	for i = 0; i < TIME_NEAR; i++ {
@@ -62,7 +89,7 @@ func (t *Timer) addNode(n *Node) {
 	expire := n.expire
 	current := t.time
 	if (expire | TIME_NEAR_MASK) == (current | TIME_NEAR_MASK) {
-		t.near[expire&TIME_NEAR_MASK].PushBack(n)
+		n.list = t.near[expire&TIME_NEAR_MASK]
 	} else {
 		var i uint32
 		var mask uint32 = TIME_NEAR << TIME_LEVEL_SHIFT
@@ -72,36 +99,166 @@ func (t *Timer) addNode(n *Node) {
 			}
 			mask <<= TIME_LEVEL_SHIFT
 		}
-		t.t[i][(expire>>(TIME_NEAR_SHIFT+i*TIME_LEVEL_SHIFT))&TIME_LEVEL_MASK].PushBack(n)
+		n.list = t.t[i][(expire>>(TIME_NEAR_SHIFT+i*TIME_LEVEL_SHIFT))&TIME_LEVEL_MASK]
+	}
+	n.elem = n.list.PushBack(n)
+}
+
+//从所在的链表中删除节点，调用者需持有锁，返回节点是否在等待触发
+func (t *Timer) removeNode(n *Node) bool {
+	if n.list == nil {
+		return false
+	}
+	n.list.Remove(n.elem)
+	n.list = nil
+	n.elem = nil
+	return true
+}
+
+//回调出错时的处理，为nil时忽略错误，需在Start之前设置
+func (t *Timer) SetErrorHandler(h ErrorHandler) {
+	t.onError = h
+}
+
+//使用workers个goroutine执行回调，最多queueSize个回调排队，队列满时按policy处理，
+//需在Start之前调用，goroutine在Start时启动，workers为0时恢复为每个回调一个goroutine
+func (t *Timer) SetDispatch(workers int, queueSize int, policy Policy) {
+	if workers <= 0 {
+		t.pool = nil
+		return
+	}
+	if queueSize < 0 {
+		queueSize = 0
 	}
+	t.pool = newPool(workers, queueSize, policy, t.quit)
 }
 
+//回调执行池的状态，没有设置执行池时返回零值
+func (t *Timer) DispatchStats() DispatchStats {
+	if t.pool == nil {
+		return DispatchStats{}
+	}
+	return t.pool.stats()
+}
+
+//兼容旧接口，fn为func(interface{})时直接调用，其他类型通过反射调用，
+//最后一个返回值为非nil的error时交给ErrorHandler
 func (t *Timer) NewTimer(d time.Duration, fn interface{}, arg interface{}) *Node {
+	return t.AfterFunc(d, legacyFunc(fn, arg))
+}
+
+//d后执行fn
+func (t *Timer) AfterFunc(d time.Duration, fn Func) *Node {
+	return t.AfterFuncName("", d, fn)
+}
+
+//d后执行fn，name用于快照恢复时找到对应的回调
+func (t *Timer) AfterFuncName(name string, d time.Duration, fn Func) *Node {
 	n := new(Node)
+	n.name = name
 	n.fn = fn
-	n.arg = arg
-	n.expire = uint32(d/t.tick) + t.time
+	n.timer = t
 	t.Lock()
+	n.expire = uint32(d/t.tick) + t.time
 	t.addNode(n)
 	t.Unlock()
 	return n
 }
 
+func (n *Node) Name() string {
+	return n.name
+}
+
+//停止节点，返回true表示节点被停止，false表示节点已经触发或已经停止
+func (n *Node) Stop() bool {
+	t := n.timer
+	t.Lock()
+	defer t.Unlock()
+	return t.removeNode(n)
+}
+
+//将节点改为从现在起d后触发，已经触发或停止的节点会被重新加入，
+//返回节点在修改前是否在等待触发
+func (t *Timer) Reschedule(n *Node, d time.Duration) bool {
+	t.Lock()
+	defer t.Unlock()
+	pending := t.removeNode(n)
+	n.timer = t
+	n.expire = uint32(d/t.tick) + t.time
+	t.addNode(n)
+	return pending
+}
+
+//已经推进的tick数
+func (t *Timer) Ticks() uint32 {
+	t.Lock()
+	defer t.Unlock()
+	return t.time
+}
+
 func (t *Timer) String() string {
 	return fmt.Sprintf("Timer:time:%d, tick:%s", t.time, t.tick)
 }
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func legacyFunc(fn interface{}, arg interface{}) Func {
+	if f, ok := fn.(func(interface{})); ok {
+		return func(ctx context.Context) error {
+			f(arg)
+			return nil
+		}
+	}
+	return func(ctx context.Context) error {
+		params := make([]reflect.Value, 0, 1)
+		params = append(params, reflect.ValueOf(arg))
+		f := reflect.ValueOf(fn)
+		results := f.Call(params)
+		if len(results) == 0 {
+			return nil
+		}
+		last := results[len(results)-1]
+		if !last.Type().Implements(errorType) {
+			return nil
+		}
+		switch last.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			if last.IsNil() {
+				return nil
+			}
+		}
+		return last.Interface().(error)
+	}
+}
+
+//执行回调，回调的错误和panic交给ErrorHandler
 func (n *Node) RunFunc() {
-	params := make([]reflect.Value, 0, 1)
-	params = append(params, reflect.ValueOf(n.arg))
-	f := reflect.ValueOf(n.fn)
-	f.Call(params)
+	t := n.timer
+	defer func() {
+		if r := recover(); r != nil {
+			t.reportError(n, fmt.Errorf("timer callback panic: %v", r))
+		}
+	}()
+	err := n.fn(t.ctx)
+	if err != nil {
+		t.reportError(n, err)
+	}
+}
+
+func (t *Timer) reportError(n *Node, err error) {
+	if t.onError != nil {
+		t.onError(n, err)
+	}
 }
 
-func dispatchList(front *list.Element) {
+func (t *Timer) dispatchList(front *list.Element) {
 	for e := front; e != nil; e = e.Next() {
 		node := e.Value.(*Node)
-		go node.RunFunc()
+		if t.pool != nil {
+			t.pool.submit(node)
+		} else {
+			go node.RunFunc()
+		}
 	}
 }
 
@@ -148,9 +305,15 @@ func (t *Timer) execute() {
 	if vec.Len() > 0 {
 		front := vec.Front()
 		vec.Init()
+		//已触发的节点不能再被停止
+		for e := front; e != nil; e = e.Next() {
+			node := e.Value.(*Node)
+			node.list = nil
+			node.elem = nil
+		}
 		t.Unlock()
 		// dispatch_list don't need lock
-		dispatchList(front)
+		t.dispatchList(front)
 		return
 	}
 	t.Unlock()
@@ -164,19 +327,33 @@ func (t *Timer) update() {
 	t.execute()
 }
 
+//按时钟经过的时间推进，接收不及时丢弃的tick会一次补齐，与skynet_updatetime相同
 func (t *Timer) Start() {
-	tick := time.NewTicker(t.tick)
+	if t.pool != nil {
+		t.pool.start()
+	}
+	tick := t.clock.NewTicker(t.tick)
 	defer tick.Stop()
+	start := t.clock.Now()
+	var elapsed int64
 	for {
 		select {
-		case <-tick.C:
-			t.update()
+		case now := <-tick.C():
+			n := int64(now.Sub(start) / t.tick)
+			for ; elapsed < n; elapsed++ {
+				t.update()
+			}
 		case <-t.quit:
 			return
 		}
 	}
 }
 
+//停止时间轮，执行池中还在排队的回调以ErrDiscarded报告
 func (t *Timer) Stop() {
+	t.cancel()
 	close(t.quit)
+	if t.pool != nil {
+		t.pool.discard()
+	}
 }
@@ -1,38 +1,522 @@
 package timer
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"runtime"
+	"sort"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/the-no/kingtask/core/clock"
 )
 
-var sum int32 = 0
-var N int32 = 300
-var tt *Timer
+func TestTimer(t *testing.T) {
+	const n = 300
+	m := clock.NewManual(time.Unix(0, 0))
+	timer := NewWithClock(time.Millisecond*10, m)
+	go timer.Start()
+	defer timer.Stop()
+	//等待Start创建ticker
+	for m.Waiters() != 1 {
+		runtime.Gosched()
+	}
+	fired := newCounter()
+	for i := 0; i < n; i++ {
+		timer.NewTimer(time.Millisecond*time.Duration(5*i), count, fired)
+	}
+	m.Advance(time.Millisecond * 5 * n)
+	fired.wait(t, n)
+	if c := fired.count(); c != n {
+		t.Errorf("count=%d", c)
+	}
+}
+
+//回调计数，每次执行后向done发送一次
+type counter struct {
+	n    int32
+	done chan struct{}
+}
+
+func newCounter() *counter {
+	return &counter{done: make(chan struct{}, 16)}
+}
+
+func count(arg interface{}) {
+	c := arg.(*counter)
+	atomic.AddInt32(&c.n, 1)
+	c.done <- struct{}{}
+}
+
+func (c *counter) count() int32 {
+	return atomic.LoadInt32(&c.n)
+}
 
-func now(arg interface{}) {
-	fmt.Println(time.Now().Format("2006-01-02 15:04:05"))
-	fmt.Println(arg)
-	atomic.AddInt32(&sum, 1)
-	v := atomic.LoadInt32(&sum)
-	if v == N {
-		tt.Stop()
+//等待回调再执行n次
+func (c *counter) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-c.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("callback not called, count=%d", c.count())
+		}
 	}
+}
 
+//节点是否还在等待触发，到期的节点在update返回前已经分发
+func isPending(n *Node) bool {
+	n.timer.Lock()
+	defer n.timer.Unlock()
+	return n.list != nil
 }
 
-func TestTimer(t *testing.T) {
-	timer := New(time.Millisecond * 10)
-	tt = timer
-	fmt.Println(timer)
-	var i int32
+//不启动Start，手动推进n个tick，回调在新的goroutine中执行
+func advance(t *Timer, n int) {
+	for i := 0; i < n; i++ {
+		t.update()
+	}
+}
+
+func TestNodeStop(t *testing.T) {
+	//分别落在near和第0、1、2层时间轮
+	ticks := []int{10, 1000, 20000, 1 << 21}
+	for _, tick := range ticks {
+		timer := New(time.Millisecond)
+		fired, stopped := newCounter(), newCounter()
+		timer.NewTimer(time.Millisecond*time.Duration(tick), count, fired)
+		n := timer.NewTimer(time.Millisecond*time.Duration(tick), count, stopped)
+		if !n.Stop() {
+			t.Fatalf("tick %d: stop should succeed", tick)
+		}
+		if n.Stop() {
+			t.Fatalf("tick %d: second stop should fail", tick)
+		}
+		advance(timer, tick+1)
+		fired.wait(t, 1)
+		if stopped.count() != 0 {
+			t.Errorf("tick %d: stopped node fired", tick)
+		}
+	}
+}
+
+func TestNodeStopAfterFire(t *testing.T) {
+	timer := New(time.Millisecond)
+	fired := newCounter()
+	n := timer.NewTimer(time.Millisecond*300, count, fired)
+	advance(timer, 301)
+	fired.wait(t, 1)
+	if n.Stop() {
+		t.Errorf("stop of a fired node should fail")
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	timer := New(time.Millisecond)
+	earlier, later := newCounter(), newCounter()
+	//从第1层提前到near
+	n1 := timer.NewTimer(time.Millisecond*20000, count, earlier)
+	if !timer.Reschedule(n1, time.Millisecond*20) {
+		t.Fatalf("reschedule of a pending node should report true")
+	}
+	//从near推迟到第1层
+	n2 := timer.NewTimer(time.Millisecond*5, count, later)
+	timer.Reschedule(n2, time.Millisecond*20000)
+
+	advance(timer, 21)
+	earlier.wait(t, 1)
+	if !isPending(n2) {
+		t.Fatalf("later node fired early")
+	}
+	advance(timer, 20000)
+	later.wait(t, 1)
+
+	//已触发的节点重新加入
+	if timer.Reschedule(n1, time.Millisecond*10) {
+		t.Errorf("reschedule of a fired node should report false")
+	}
+	advance(timer, 11)
+	earlier.wait(t, 1)
+}
+
+func TestAfterFuncError(t *testing.T) {
+	timer := New(time.Millisecond)
+	errs := make(chan error, 2)
+	timer.SetErrorHandler(func(n *Node, err error) {
+		errs <- err
+	})
+	fired := newCounter()
+	timer.AfterFunc(time.Millisecond*5, func(ctx context.Context) error {
+		count(fired)
+		return nil
+	})
+	timer.AfterFunc(time.Millisecond*5, func(ctx context.Context) error {
+		return errors.New("redis unavailable")
+	})
+	timer.AfterFunc(time.Millisecond*5, func(ctx context.Context) error {
+		panic("boom")
+	})
+	advance(timer, 6)
+	fired.wait(t, 1)
+	got := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			got = append(got, err.Error())
+		case <-time.After(time.Second):
+			t.Fatalf("error handler not called, got %v", got)
+		}
+	}
+	sort.Strings(got)
+	if got[0] != "redis unavailable" || got[1] != "timer callback panic: boom" {
+		t.Errorf("errors %v", got)
+	}
+}
+
+func TestNewTimerReflect(t *testing.T) {
+	timer := New(time.Millisecond)
+	sums := make(chan int, 1)
+	timer.NewTimer(time.Millisecond*5, func(n int) {
+		sums <- n
+	}, 3)
+	//签名错误的回调不会导致进程崩溃
+	errs := make(chan error, 1)
+	timer.SetErrorHandler(func(n *Node, err error) {
+		errs <- err
+	})
+	timer.NewTimer(time.Millisecond*5, func(a, b int) {}, 3)
+	advance(timer, 6)
+	select {
+	case sum := <-sums:
+		if sum != 3 {
+			t.Errorf("sum=%d", sum)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("reflect callback not called")
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Errorf("wrong signature should be reported")
+	}
+}
+
+func TestNewTimerReflectError(t *testing.T) {
+	timer := New(time.Millisecond)
+	var errs []error
+	timer.SetErrorHandler(func(n *Node, err error) {
+		errs = append(errs, err)
+	})
+	errFail := errors.New("fail")
+	fail := timer.NewTimer(time.Millisecond*5, func(arg string) error {
+		return errFail
+	}, "fail")
+	ok := timer.NewTimer(time.Millisecond*5, func(arg string) (int, error) {
+		return 0, nil
+	}, "ok")
+	//直接执行回调，错误同步交给ErrorHandler
+	fail.RunFunc()
+	ok.RunFunc()
+	if len(errs) != 1 || errs[0] != errFail {
+		t.Errorf("errs=%v", errs)
+	}
+}
+
+func TestStopCancelsContext(t *testing.T) {
+	timer := New(time.Millisecond)
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	timer.AfterFunc(0, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil
+	})
+	advance(timer, 1)
+	<-started
+	timer.Stop()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("err=%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("context should be cancelled by Stop")
+	}
+}
+
+func TestManualClock(t *testing.T) {
+	m := clock.NewManual(time.Unix(0, 0))
+	timer := NewWithClock(time.Second, m)
+	//跨越多层时间轮的长延时
+	delays := []time.Duration{time.Minute, time.Hour, 3 * time.Hour, 30 * time.Hour}
+	fired := make([]*counter, len(delays))
+	nodes := make([]*Node, len(delays))
+	//在每个延时的前一个tick触发，表示Start已经推进到这里
+	sentinels := make([]*counter, len(delays))
+	for i, d := range delays {
+		fired[i], sentinels[i] = newCounter(), newCounter()
+		nodes[i] = timer.NewTimer(d, count, fired[i])
+		timer.NewTimer(d-time.Second, count, sentinels[i])
+	}
 	go timer.Start()
-	for i = 0; i < N; i++ {
-		timer.NewTimer(time.Millisecond*time.Duration(5*i), now, 12)
+	defer timer.Stop()
+	//等待Start创建ticker
+	for m.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
+	var elapsed time.Duration
+	for i, d := range delays {
+		m.Advance(d - elapsed - time.Second)
+		sentinels[i].wait(t, 1)
+		if !isPending(nodes[i]) {
+			t.Fatalf("delay %s fired early", d)
+		}
+
+		m.Advance(time.Second)
+		elapsed = d
+		fired[i].wait(t, 1)
+		for j := range delays {
+			if j < i && fired[j].count() != 1 || i < j && !isPending(nodes[j]) {
+				t.Fatalf("after %s, delay %s fired %d times", d, delays[j], fired[j].count())
+			}
+		}
 	}
-	time.Sleep(time.Second * 10)
-	if sum != N {
-		t.Errorf("sum=%d,fail", sum)
+}
+
+func TestLevelCounts(t *testing.T) {
+	timer := New(time.Millisecond)
+	n := newCounter()
+	//分别落在near和第0、1、2层时间轮
+	ticks := []int{1 << 21, 20000, 1000, 10}
+	for _, tick := range ticks {
+		timer.NewTimer(time.Millisecond*time.Duration(tick), count, n)
+	}
+	if counts := timer.LevelCounts(); counts != [5]int{1, 1, 1, 1, 0} {
+		t.Fatalf("level counts %v", counts)
+	}
+
+	pending := timer.Pending()
+	if len(pending) != len(ticks) {
+		t.Fatalf("pending %d", len(pending))
+	}
+	for i, p := range pending {
+		want := time.Millisecond * time.Duration(ticks[len(ticks)-1-i])
+		if p.Due != want {
+			t.Errorf("pending[%d] due %s, want %s", i, p.Due, want)
+		}
+	}
+
+	advance(timer, 10)
+	n.wait(t, 1)
+	if timer.Len() != 3 {
+		t.Fatalf("len %d", timer.Len())
+	}
+	if due := timer.Pending()[0].Due; due != time.Millisecond*990 {
+		t.Errorf("due %s after advance", due)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	timer := New(time.Millisecond)
+	noop := func(ctx context.Context) error { return nil }
+	timer.AfterFuncName("late", 5*time.Second, noop)
+	timer.AfterFuncName("early", time.Second, noop)
+	timer.AfterFuncName("unknown", 2*time.Second, noop)
+	//没有名字的节点不在快照中
+	timer.AfterFunc(3*time.Second, noop)
+	data, err := timer.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fired := []*counter{newCounter(), newCounter()}
+	restored := New(time.Millisecond * 10)
+	nodes, err := restored.Restore(data, func(name string) Func {
+		var i int
+		switch name {
+		case "early":
+			i = 0
+		case "late":
+			i = 1
+		default:
+			return nil
+		}
+		return func(ctx context.Context) error {
+			count(fired[i])
+			return nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].Name() != "early" || nodes[1].Name() != "late" {
+		t.Fatalf("restored %v", nodes)
+	}
+	pending := restored.Pending()
+	if len(pending) != 2 || pending[0].Due != time.Second || pending[1].Due != 5*time.Second {
+		t.Fatalf("pending %v", pending)
+	}
+
+	advance(restored, 100)
+	fired[0].wait(t, 1)
+	if !isPending(nodes[1]) {
+		t.Fatalf("late node fired early")
+	}
+
+	if _, err := restored.Restore([]byte("{"), nil); err == nil {
+		t.Errorf("restore invalid snapshot")
+	}
+}
+
+func benchmarkRunFunc(b *testing.B, n *Node) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		n.RunFunc()
+	}
+}
+
+func BenchmarkRunFuncTyped(b *testing.B) {
+	var sum int64
+	n := New(time.Millisecond).AfterFunc(time.Hour, func(ctx context.Context) error {
+		sum++
+		return nil
+	})
+	benchmarkRunFunc(b, n)
+}
+
+func BenchmarkRunFuncLegacy(b *testing.B) {
+	var sum int64
+	n := New(time.Millisecond).NewTimer(time.Hour, func(arg interface{}) {
+		sum += arg.(int64)
+	}, int64(1))
+	benchmarkRunFunc(b, n)
+}
+
+func BenchmarkRunFuncReflect(b *testing.B) {
+	var sum int64
+	n := New(time.Millisecond).NewTimer(time.Hour, func(arg int64) {
+		sum += arg
+	}, int64(1))
+	benchmarkRunFunc(b, n)
+}
+
+//n个到期时间相同的回调，开始执行时计数，阻塞直到release关闭
+func blockingNodes(timer *Timer, n int, started *counter, release chan struct{}) {
+	for i := 0; i < n; i++ {
+		timer.AfterFunc(time.Millisecond*5, func(ctx context.Context) error {
+			count(started)
+			<-release
+			return nil
+		})
+	}
+}
+
+func TestDispatchPoolBounded(t *testing.T) {
+	timer := New(time.Millisecond)
+	defer timer.Stop()
+	timer.SetDispatch(2, 100, PolicyBlock)
+	//不启动Start，由advance手动推进
+	timer.pool.start()
+	started := newCounter()
+	release := make(chan struct{})
+	blockingNodes(timer, 10, started, release)
+	advance(timer, 6)
+
+	started.wait(t, 2)
+	stats := timer.DispatchStats()
+	if stats.Running != 2 || stats.Queued != 8 {
+		t.Errorf("stats %+v", stats)
+	}
+	close(release)
+	started.wait(t, 8)
+	stats = timer.DispatchStats()
+	if stats.Dispatched != 10 || stats.Queued != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestDispatchPoolDrop(t *testing.T) {
+	timer := New(time.Millisecond)
+	defer timer.Stop()
+	var dropped int32
+	timer.SetErrorHandler(func(n *Node, err error) {
+		if err == ErrDropped {
+			atomic.AddInt32(&dropped, 1)
+		}
+	})
+	timer.SetDispatch(1, 2, PolicyDrop)
+	//不启动Start，由advance手动推进
+	timer.pool.start()
+	started := newCounter()
+	release := make(chan struct{})
+	//第一个回调执行中，两个排队，其余丢弃
+	blockingNodes(timer, 1, started, release)
+	advance(timer, 6)
+	started.wait(t, 1)
+	blockingNodes(timer, 5, started, release)
+	advance(timer, 6)
+
+	stats := timer.DispatchStats()
+	if stats.Dropped != 3 || atomic.LoadInt32(&dropped) != 3 || stats.Queued != 2 {
+		t.Errorf("dropped=%d stats %+v", dropped, stats)
+	}
+	close(release)
+	started.wait(t, 2)
+	if stats := timer.DispatchStats(); stats.Dispatched != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestDispatchPoolSpill(t *testing.T) {
+	timer := New(time.Millisecond)
+	defer timer.Stop()
+	timer.SetDispatch(1, 2, PolicySpill)
+	//不启动Start，由advance手动推进
+	timer.pool.start()
+	started := newCounter()
+	release := make(chan struct{})
+	blockingNodes(timer, 1, started, release)
+	advance(timer, 6)
+	started.wait(t, 1)
+	blockingNodes(timer, 5, started, release)
+	advance(timer, 6)
+
+	//溢出队列中等待放回执行队列的回调不计入Spilled
+	stats := timer.DispatchStats()
+	if stats.Dropped != 0 || stats.Queued != 2 || stats.Spilled < 2 || 3 < stats.Spilled {
+		t.Errorf("stats %+v", stats)
+	}
+	close(release)
+	started.wait(t, 5)
+	stats = timer.DispatchStats()
+	if stats.Dispatched != 6 || stats.Spilled != 0 || stats.Queued != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestDispatchPoolStop(t *testing.T) {
+	timer := New(time.Millisecond)
+	var discarded int32
+	timer.SetErrorHandler(func(n *Node, err error) {
+		if err == ErrDiscarded {
+			atomic.AddInt32(&discarded, 1)
+		}
+	})
+	timer.SetDispatch(1, 10, PolicyBlock)
+	started := newCounter()
+	release := make(chan struct{})
+	defer close(release)
+	//没有Start时不执行回调
+	blockingNodes(timer, 3, started, release)
+	advance(timer, 6)
+	if stats := timer.DispatchStats(); started.count() != 0 || stats.Queued != 3 {
+		t.Fatalf("started=%d stats %+v", started.count(), stats)
+	}
+
+	timer.Stop()
+	if stats := timer.DispatchStats(); atomic.LoadInt32(&discarded) != 3 || stats.Queued != 0 {
+		t.Errorf("discarded=%d stats %+v", discarded, stats)
 	}
 }
@@ -0,0 +1,795 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+)
+
+type memoryResult struct {
+	result   task.TaskResult
+	expireAt time.Time
+}
+
+type memoryUniqueKey struct {
+	uuid     string
+	expireAt time.Time
+}
+
+type memoryCounter struct {
+	value    int64
+	expireAt time.Time
+}
+
+//MemoryStore是进程内的Store实现，broker和worker共用同一个实例即可在没有redis时运行
+type MemoryStore struct {
+	sync.Mutex
+	requests map[string]task.TaskRequest
+	//待执行队列 -> uuid列表
+	ready map[string][]string
+	delay map[string]delayEntry
+	//延时任务的提交序号，同一时刻的任务按提交顺序到期
+	delaySeq uint64
+	//所有提交过任务的队列
+	queues map[string]bool
+	//order_key -> 持有该key的任务
+	orderLocks map[string]string
+	//order_key -> 等待中的任务
+	orderWaiting map[string][]string
+	//workerId -> uuid -> 租约到期时刻
+	leases   map[string]map[string]int64
+	results  map[string]memoryResult
+	failed   []string
+	counters map[string]memoryCounter
+	//幂等key -> 占用的任务
+	uniqueKeys map[string]memoryUniqueKey
+	//已取消的任务 -> 标记过期时刻
+	cancelled map[string]time.Time
+	schedules map[string]task.Schedule
+	workflows map[string]task.Workflow
+	finished  []string
+	groups    map[string]*memoryGroup
+	//concurrency_key -> uuid -> 位置过期时刻
+	slots map[string]map[string]int64
+	//concurrency_key -> 等待位置的任务
+	slotWaiting map[string][]string
+	//有任务等待的concurrency_key -> concurrency_limit
+	slotWaitLimits map[string]int
+	//leader租约的持有者和过期时刻
+	leader         string
+	leaderExpireAt time.Time
+}
+
+type memoryGroup struct {
+	group task.Group
+	done  map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := new(MemoryStore)
+	s.requests = make(map[string]task.TaskRequest)
+	s.ready = make(map[string][]string)
+	s.delay = make(map[string]delayEntry)
+	s.queues = make(map[string]bool)
+	s.orderLocks = make(map[string]string)
+	s.orderWaiting = make(map[string][]string)
+	s.leases = make(map[string]map[string]int64)
+	s.results = make(map[string]memoryResult)
+	s.counters = make(map[string]memoryCounter)
+	s.uniqueKeys = make(map[string]memoryUniqueKey)
+	s.cancelled = make(map[string]time.Time)
+	s.schedules = make(map[string]task.Schedule)
+	s.workflows = make(map[string]task.Workflow)
+	s.groups = make(map[string]*memoryGroup)
+	s.slots = make(map[string]map[string]int64)
+	s.slotWaiting = make(map[string][]string)
+	s.slotWaitLimits = make(map[string]int)
+	return s
+}
+
+func (s *MemoryStore) SaveRequest(r *task.TaskRequest) error {
+	s.Lock()
+	defer s.Unlock()
+	s.requests[r.Uuid] = *r
+	return nil
+}
+
+func (s *MemoryStore) GetRequest(uuid string) (*task.TaskRequest, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.requests[uuid]
+	if !ok {
+		return nil, errors.ErrRequestNotExist
+	}
+	return &r, nil
+}
+
+func (s *MemoryStore) DeleteRequest(uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.requests, uuid)
+	return nil
+}
+
+func (s *MemoryStore) Enqueue(r *task.TaskRequest) error {
+	s.Lock()
+	defer s.Unlock()
+	s.requests[r.Uuid] = *r
+	s.pushReady(r.Uuid, false)
+	return nil
+}
+
+func (s *MemoryStore) Schedule(r *task.TaskRequest, startTime int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.requests[r.Uuid] = *r
+	s.queues[queueName(r.Queue)] = true
+	s.addDelay(r.Uuid, startTime)
+	return nil
+}
+
+//延时任务的执行时刻和提交序号
+type delayEntry struct {
+	startTime int64
+	seq       uint64
+}
+
+//先按执行时刻，再按提交顺序
+func (e delayEntry) before(o delayEntry) bool {
+	if e.startTime != o.startTime {
+		return e.startTime < o.startTime
+	}
+	return e.seq < o.seq
+}
+
+//调用者需持有锁
+func (s *MemoryStore) addDelay(uuid string, startTime int64) {
+	s.delaySeq++
+	s.delay[uuid] = delayEntry{startTime: startTime, seq: s.delaySeq}
+}
+
+func (s *MemoryStore) PromoteDue(now int64, limit int) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	due := make([]string, 0)
+	for uuid, entry := range s.delay {
+		if entry.startTime <= now {
+			due = append(due, uuid)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return s.delay[due[i]].before(s.delay[due[j]])
+	})
+	if limit < len(due) {
+		due = due[:limit]
+	}
+	for _, uuid := range due {
+		delete(s.delay, uuid)
+		s.pushReady(uuid, false)
+	}
+	return due, nil
+}
+
+func (s *MemoryStore) Dequeue(workerId string, readyKeys []string, deadline int64) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, key := range readyKeys {
+		if len(s.ready[key]) == 0 {
+			continue
+		}
+		uuid := s.ready[key][0]
+		s.ready[key] = s.ready[key][1:]
+		if s.leases[workerId] == nil {
+			s.leases[workerId] = make(map[string]int64)
+		}
+		s.leases[workerId][uuid] = deadline
+		return uuid, nil
+	}
+	return "", errors.ErrQueueEmpty
+}
+
+func (s *MemoryStore) ExtendLease(workerId string, uuid string, deadline int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.leases[workerId][uuid]; ok {
+		s.leases[workerId][uuid] = deadline
+	}
+	return nil
+}
+
+func (s *MemoryStore) Ack(workerId string, uuid string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.leases[workerId][uuid]
+	//租约已过期，任务可能已被重新投递
+	if !ok {
+		return false, nil
+	}
+	delete(s.leases[workerId], uuid)
+	delete(s.requests, uuid)
+	return true, nil
+}
+
+func (s *MemoryStore) AcquireSlot(workerId string, key string, uuid string, limit int, now int64, deadline int64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.fillSlots(key, limit, now, deadline)
+	slots := s.slots[key]
+	if _, held := slots[uuid]; held || len(slots) < limit {
+		slots[uuid] = deadline
+		return true, nil
+	}
+	if _, ok := s.leases[workerId][uuid]; !ok {
+		return false, nil
+	}
+	delete(s.leases[workerId], uuid)
+	s.slotWaiting[key] = append(s.slotWaiting[key], uuid)
+	s.slotWaitLimits[key] = limit
+	return false, nil
+}
+
+func (s *MemoryStore) ReleaseSlot(key string, uuid string, limit int, now int64, deadline int64) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.slots[key], uuid)
+	s.fillSlots(key, limit, now, deadline)
+	return nil
+}
+
+//清除过期的位置，把空出的位置按等待顺序分配给等待中的任务并放回待执行队列头部
+func (s *MemoryStore) fillSlots(key string, limit int, now int64, deadline int64) []string {
+	slots, ok := s.slots[key]
+	if !ok {
+		slots = make(map[string]int64)
+		s.slots[key] = slots
+	}
+	for id, expireAt := range slots {
+		if expireAt <= now {
+			delete(slots, id)
+		}
+	}
+	woken := make([]string, 0)
+	waiting := s.slotWaiting[key]
+	for len(slots) < limit && len(waiting) != 0 {
+		uuid := waiting[0]
+		waiting = waiting[1:]
+		if _, ok := s.requests[uuid]; !ok {
+			continue
+		}
+		slots[uuid] = deadline
+		woken = append(woken, uuid)
+	}
+	if len(waiting) == 0 {
+		delete(s.slotWaiting, key)
+		delete(s.slotWaitLimits, key)
+	} else {
+		s.slotWaiting[key] = waiting
+	}
+	for i := len(woken) - 1; i >= 0; i-- {
+		s.pushReady(woken[i], true)
+	}
+	return woken
+}
+
+func (s *MemoryStore) Defer(workerId string, uuid string, startTime int64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.leases[workerId][uuid]; !ok {
+		return false, nil
+	}
+	delete(s.leases[workerId], uuid)
+	s.addDelay(uuid, startTime)
+	return true, nil
+}
+
+func (s *MemoryStore) RequeueExpired(now int64) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	requeued := make([]string, 0)
+	for workerId, leases := range s.leases {
+		for uuid, deadline := range leases {
+			if deadline > now {
+				continue
+			}
+			delete(leases, uuid)
+			if _, ok := s.requests[uuid]; ok {
+				s.pushReady(uuid, true)
+				requeued = append(requeued, uuid)
+			}
+		}
+		if len(leases) == 0 {
+			delete(s.leases, workerId)
+		}
+	}
+	//worker崩溃后位置随租约过期，分配给等待中的任务
+	for key, limit := range s.slotWaitLimits {
+		woken := s.fillSlots(key, limit, now, now+config.DefaultLeaseTime)
+		requeued = append(requeued, woken...)
+	}
+	return requeued, nil
+}
+
+func (s *MemoryStore) ClaimUniqueKey(key string, uuid string, window time.Duration) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, ok := s.uniqueKeys[key]
+	if ok && time.Now().Before(u.expireAt) {
+		return u.uuid, nil
+	}
+	s.uniqueKeys[key] = memoryUniqueKey{
+		uuid:     uuid,
+		expireAt: time.Now().Add(window),
+	}
+	return uuid, nil
+}
+
+func (s *MemoryStore) ReleaseUniqueKey(key string, uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.uniqueKeys[key].uuid == uuid {
+		delete(s.uniqueKeys, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Cancel(uuid string, keepTime time.Duration) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.cancelled[uuid] = time.Now().Add(keepTime)
+	r, ok := s.requests[uuid]
+	if !ok {
+		return false, nil
+	}
+	_, removed := s.delay[uuid]
+	delete(s.delay, uuid)
+	key := ReadyKey(r.Queue, r.Priority)
+	if uuids, ok := removeString(s.ready[key], uuid); ok {
+		s.ready[key] = uuids
+		removed = true
+	}
+	if uuids, ok := removeString(s.orderWaiting[r.OrderKey], uuid); ok {
+		s.orderWaiting[r.OrderKey] = uuids
+		removed = true
+	}
+	if uuids, ok := removeString(s.slotWaiting[r.ConcurrencyKey], uuid); ok {
+		s.slotWaiting[r.ConcurrencyKey] = uuids
+		removed = true
+	}
+	if removed {
+		delete(s.requests, uuid)
+	}
+	return removed, nil
+}
+
+func (s *MemoryStore) IsCancelled(uuid string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	expireAt, ok := s.cancelled[uuid]
+	if !ok || time.Now().After(expireAt) {
+		delete(s.cancelled, uuid)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) ReleaseOrderKey(orderKey string, uuid string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.orderLocks[orderKey] != uuid {
+		return "", nil
+	}
+	delete(s.orderLocks, orderKey)
+	waiting := s.orderWaiting[orderKey]
+	if len(waiting) == 0 {
+		return "", nil
+	}
+	next := waiting[0]
+	s.orderWaiting[orderKey] = waiting[1:]
+	if len(s.orderWaiting[orderKey]) == 0 {
+		delete(s.orderWaiting, orderKey)
+	}
+	s.pushReady(next, false)
+	return next, nil
+}
+
+func (s *MemoryStore) UndoCount(queue string) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	var count int64
+	for _, priority := range task.Priorities {
+		count += int64(len(s.ready[ReadyKey(queue, priority)]))
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) DelayCount() (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	return int64(len(s.delay)), nil
+}
+
+func (s *MemoryStore) Delayed(offset int, limit int) ([]Delayed, error) {
+	s.Lock()
+	defer s.Unlock()
+	uuids := make([]string, 0, len(s.delay))
+	for uuid := range s.delay {
+		uuids = append(uuids, uuid)
+	}
+	sort.Slice(uuids, func(i, j int) bool {
+		return s.delay[uuids[i]].before(s.delay[uuids[j]])
+	})
+	delayed := make([]Delayed, 0, len(uuids))
+	for _, uuid := range uuids {
+		delayed = append(delayed, Delayed{Uuid: uuid, StartTime: s.delay[uuid].startTime})
+	}
+	if offset < 0 || len(delayed) <= offset || limit <= 0 {
+		return []Delayed{}, nil
+	}
+	delayed = delayed[offset:]
+	if limit < len(delayed) {
+		delayed = delayed[:limit]
+	}
+	return delayed, nil
+}
+
+func (s *MemoryStore) Queues() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	queues := make([]string, 0, len(s.queues))
+	for queue := range s.queues {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues, nil
+}
+
+func (s *MemoryStore) SaveSchedule(sc *task.Schedule) error {
+	s.Lock()
+	defer s.Unlock()
+	s.schedules[sc.Id] = *sc
+	return nil
+}
+
+func (s *MemoryStore) GetSchedule(id string) (*task.Schedule, error) {
+	s.Lock()
+	defer s.Unlock()
+	sc, ok := s.schedules[id]
+	if !ok {
+		return nil, errors.ErrScheduleNotExist
+	}
+	return &sc, nil
+}
+
+func (s *MemoryStore) DeleteSchedule(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.schedules, id)
+	return nil
+}
+
+func (s *MemoryStore) Schedules() ([]*task.Schedule, error) {
+	s.Lock()
+	defer s.Unlock()
+	schedules := make([]*task.Schedule, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		sc := sc
+		schedules = append(schedules, &sc)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].NextTime == schedules[j].NextTime {
+			return schedules[i].Id < schedules[j].Id
+		}
+		return schedules[i].NextTime < schedules[j].NextTime
+	})
+	return schedules, nil
+}
+
+func (s *MemoryStore) DueSchedules(now int64, limit int) ([]string, error) {
+	schedules, _ := s.Schedules()
+	ids := make([]string, 0)
+	for _, sc := range schedules {
+		if now < sc.NextTime || len(ids) == limit {
+			break
+		}
+		ids = append(ids, sc.Id)
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) AdvanceSchedule(id string, fireTime int64, nextTime int64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	sc, ok := s.schedules[id]
+	if !ok || sc.NextTime != fireTime {
+		return false, nil
+	}
+	sc.NextTime = nextTime
+	s.schedules[id] = sc
+	return true, nil
+}
+
+func (s *MemoryStore) FinishSchedule(id string, fireTime int64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	sc, ok := s.schedules[id]
+	if !ok || sc.NextTime != fireTime {
+		return false, nil
+	}
+	delete(s.schedules, id)
+	return true, nil
+}
+
+func (s *MemoryStore) SaveWorkflow(w *task.Workflow) error {
+	s.Lock()
+	defer s.Unlock()
+	s.workflows[w.Id] = copyWorkflow(w)
+	return nil
+}
+
+func (s *MemoryStore) GetWorkflow(id string) (*task.Workflow, error) {
+	s.Lock()
+	defer s.Unlock()
+	w, ok := s.workflows[id]
+	if !ok {
+		return nil, errors.ErrWorkflowNotExist
+	}
+	ret := copyWorkflow(&w)
+	return &ret, nil
+}
+
+func (s *MemoryStore) SetWorkflowState(id string, node string, from string, to string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	w, ok := s.workflows[id]
+	if !ok {
+		return false, nil
+	}
+	n := w.Node(node)
+	if n == nil || n.State != from {
+		return false, nil
+	}
+	n.State = to
+	return true, nil
+}
+
+//节点保存在切片中，复制后修改才不会影响调用者
+func copyWorkflow(w *task.Workflow) task.Workflow {
+	ret := *w
+	ret.Nodes = append([]task.WorkflowNode(nil), w.Nodes...)
+	return ret
+}
+
+func (s *MemoryStore) SaveGroup(g *task.Group) error {
+	s.Lock()
+	defer s.Unlock()
+	group := *g
+	group.Members = append([]string(nil), g.Members...)
+	s.groups[g.Id] = &memoryGroup{group: group, done: make(map[string]bool)}
+	return nil
+}
+
+func (s *MemoryStore) GetGroup(id string) (*task.Group, error) {
+	s.Lock()
+	defer s.Unlock()
+	g, ok := s.groups[id]
+	if !ok {
+		return nil, errors.ErrGroupNotExist
+	}
+	ret := g.group
+	ret.Members = append([]string(nil), g.group.Members...)
+	return &ret, nil
+}
+
+func (s *MemoryStore) FinishGroupMember(id string, uuid string, success bool) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	g, ok := s.groups[id]
+	if !ok {
+		return false, errors.ErrGroupNotExist
+	}
+	if g.done[uuid] {
+		return false, nil
+	}
+	g.done[uuid] = true
+	if success {
+		g.group.Completed++
+	} else {
+		g.group.Failed++
+	}
+	return g.group.Pending() == 0, nil
+}
+
+func (s *MemoryStore) SaveResult(r *task.TaskResult, keepTime time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	s.results[r.Uuid] = memoryResult{
+		result:   *r,
+		expireAt: time.Now().Add(keepTime),
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetResult(uuid string) (*task.TaskResult, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.results[uuid]
+	if !ok || time.Now().After(r.expireAt) {
+		delete(s.results, uuid)
+		return nil, errors.ErrResultNotExist
+	}
+	return &r.result, nil
+}
+
+func (s *MemoryStore) DeleteResult(uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.results, uuid)
+	return nil
+}
+
+func (s *MemoryStore) AddFailed(uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.failed = addString(s.failed, uuid)
+	return nil
+}
+
+func (s *MemoryStore) PopFailed() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.failed) == 0 {
+		return "", errors.ErrQueueEmpty
+	}
+	uuid := s.failed[0]
+	s.failed = s.failed[1:]
+	return uuid, nil
+}
+
+func (s *MemoryStore) AddFinished(uuid string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.finished = addString(s.finished, uuid)
+	return nil
+}
+
+func (s *MemoryStore) PopFinished() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.finished) == 0 {
+		return "", errors.ErrQueueEmpty
+	}
+	uuid := s.finished[0]
+	s.finished = s.finished[1:]
+	return uuid, nil
+}
+
+func (s *MemoryStore) IncrCounter(key string, expire time.Duration) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.counters[key]
+	if !ok || time.Now().After(c.expireAt) {
+		c = memoryCounter{expireAt: time.Now().Add(expire)}
+	}
+	c.value++
+	s.counters[key] = c
+	return c.value, nil
+}
+
+func (s *MemoryStore) GetCounter(key string) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.counters[key]
+	if !ok || time.Now().After(c.expireAt) {
+		return 0, nil
+	}
+	return c.value, nil
+}
+
+func (s *MemoryStore) TakeRate(counters []RateCounter) ([]int, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	full := make([]int, 0)
+	for i, rc := range counters {
+		c, ok := s.counters[rc.Key]
+		if ok && now.Before(c.expireAt) && c.value >= rc.Limit {
+			full = append(full, i)
+		}
+	}
+	if len(full) != 0 {
+		return full, nil
+	}
+	for _, rc := range counters {
+		c, ok := s.counters[rc.Key]
+		if !ok || now.After(c.expireAt) {
+			c = memoryCounter{expireAt: now.Add(rc.Expire)}
+		}
+		c.value++
+		s.counters[rc.Key] = c
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) AcquireLeader(id string, lease time.Duration) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if len(s.leader) != 0 && s.leader != id && now.Before(s.leaderExpireAt) {
+		return false, nil
+	}
+	s.leader = id
+	s.leaderExpireAt = now.Add(lease)
+	return true, nil
+}
+
+func (s *MemoryStore) ReleaseLeader(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.leader == id {
+		s.leader = ""
+	}
+	return nil
+}
+
+func (s *MemoryStore) Leader() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if time.Now().After(s.leaderExpireAt) {
+		return "", nil
+	}
+	return s.leader, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+//和redis实现一样，order_key被其他任务持有时进入等待列表
+func (s *MemoryStore) pushReady(uuid string, front bool) {
+	r := s.requests[uuid]
+	if len(r.OrderKey) != 0 {
+		holder, ok := s.orderLocks[r.OrderKey]
+		if ok && holder != uuid {
+			s.orderWaiting[r.OrderKey] = append(s.orderWaiting[r.OrderKey], uuid)
+			return
+		}
+		s.orderLocks[r.OrderKey] = uuid
+	}
+	s.queues[queueName(r.Queue)] = true
+	key := ReadyKey(r.Queue, r.Priority)
+	if front {
+		s.ready[key] = append([]string{uuid}, s.ready[key]...)
+	} else {
+		s.ready[key] = append(s.ready[key], uuid)
+	}
+}
+
+//和redis集合一致，已存在时不重复添加
+func addString(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func removeString(values []string, value string) ([]string, bool) {
+	for i, v := range values {
+		if v == value {
+			return append(values[:i:i], values[i+1:]...), true
+		}
+	}
+	return values, false
+}
+
+func queueName(queue string) string {
+	if len(queue) == 0 {
+		return task.DefaultQueue
+	}
+	return queue
+}
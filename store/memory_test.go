@@ -0,0 +1,654 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+)
+
+func newRequest(uuid string) *task.TaskRequest {
+	return &task.TaskRequest{
+		Uuid:     uuid,
+		BinName:  "example",
+		Args:     "1 2",
+		TaskType: task.ScriptTask,
+	}
+}
+
+var allKeys = []string{
+	ReadyKey(task.DefaultQueue, task.PriorityHigh),
+	ReadyKey(task.DefaultQueue, task.PriorityNormal),
+	ReadyKey(task.DefaultQueue, task.PriorityLow),
+}
+
+func TestMemoryStoreDequeueAck(t *testing.T) {
+	s := NewMemoryStore()
+	if _, err := s.Dequeue("w1", allKeys, 10); err != errors.ErrQueueEmpty {
+		t.Fatalf("dequeue empty queue, err=%v", err)
+	}
+	s.Enqueue(newRequest("a"))
+	s.Enqueue(newRequest("b"))
+	if count, _ := s.UndoCount(task.DefaultQueue); count != 2 {
+		t.Fatalf("undo count=%d", count)
+	}
+
+	uuid, err := s.Dequeue("w1", allKeys, 10)
+	if err != nil || uuid != "a" {
+		t.Fatalf("dequeue uuid=%s, err=%v", uuid, err)
+	}
+	r, err := s.GetRequest(uuid)
+	if err != nil || r.BinName != "example" {
+		t.Fatalf("get request %v, err=%v", r, err)
+	}
+	held, _ := s.Ack("w1", uuid)
+	if !held {
+		t.Errorf("ack should release a held lease")
+	}
+	if _, err := s.GetRequest(uuid); err != errors.ErrRequestNotExist {
+		t.Errorf("request should be deleted after ack, err=%v", err)
+	}
+}
+
+func TestMemoryStorePriority(t *testing.T) {
+	s := NewMemoryStore()
+	low := newRequest("low")
+	low.Priority = task.PriorityLow
+	high := newRequest("high")
+	high.Priority = task.PriorityHigh
+	s.Enqueue(low)
+	s.Enqueue(newRequest("normal"))
+	s.Enqueue(high)
+
+	for _, want := range []string{"high", "normal", "low"} {
+		uuid, err := s.Dequeue("w1", allKeys, 10)
+		if err != nil || uuid != want {
+			t.Errorf("dequeue uuid=%s, want %s, err=%v", uuid, want, err)
+		}
+	}
+}
+
+func TestMemoryStoreQueue(t *testing.T) {
+	s := NewMemoryStore()
+	heavy := newRequest("heavy")
+	heavy.Queue = "heavy"
+	s.Enqueue(heavy)
+	s.Enqueue(newRequest("a"))
+
+	if _, err := s.Dequeue("w1", []string{ReadyKey("rpc", task.PriorityNormal)}, 10); err != errors.ErrQueueEmpty {
+		t.Errorf("dequeue unsubscribed queue, err=%v", err)
+	}
+	uuid, err := s.Dequeue("w1", []string{ReadyKey("heavy", task.PriorityNormal)}, 10)
+	if err != nil || uuid != "heavy" {
+		t.Errorf("dequeue uuid=%s, err=%v", uuid, err)
+	}
+	queues, _ := s.Queues()
+	if len(queues) != 2 || queues[0] != task.DefaultQueue || queues[1] != "heavy" {
+		t.Errorf("queues=%v", queues)
+	}
+	if count, _ := s.UndoCount("heavy"); count != 0 {
+		t.Errorf("heavy undo count=%d", count)
+	}
+	if count, _ := s.UndoCount(task.DefaultQueue); count != 1 {
+		t.Errorf("default undo count=%d", count)
+	}
+}
+
+func TestMemoryStoreFIFO(t *testing.T) {
+	s := NewMemoryStore()
+	for _, uuid := range []string{"a", "b", "c"} {
+		s.Enqueue(newRequest(uuid))
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		uuid, _ := s.Dequeue("w1", allKeys, 10)
+		if uuid != want {
+			t.Errorf("dequeue uuid=%s, want %s", uuid, want)
+		}
+	}
+}
+
+func TestMemoryStoreOrderKey(t *testing.T) {
+	s := NewMemoryStore()
+	for _, uuid := range []string{"a", "b", "c"} {
+		r := newRequest(uuid)
+		r.OrderKey = "customer-1"
+		s.Enqueue(r)
+	}
+	s.Enqueue(newRequest("other"))
+	if count, _ := s.UndoCount(task.DefaultQueue); count != 2 {
+		t.Fatalf("only the key holder should be ready, undo count=%d", count)
+	}
+
+	if next, _ := s.ReleaseOrderKey("customer-1", "b"); next != "" {
+		t.Errorf("release by a non holder should be ignored, next=%s", next)
+	}
+	holder := "a"
+	for _, want := range []string{"b", "c", ""} {
+		next, _ := s.ReleaseOrderKey("customer-1", holder)
+		if next != want {
+			t.Errorf("next=%s, want %s", next, want)
+		}
+		holder = next
+	}
+	uuids := make([]string, 0)
+	for {
+		uuid, err := s.Dequeue("w1", allKeys, 10)
+		if err != nil {
+			break
+		}
+		uuids = append(uuids, uuid)
+	}
+	if len(uuids) != 4 || uuids[0] != "a" || uuids[2] != "b" || uuids[3] != "c" {
+		t.Errorf("dequeue order %v", uuids)
+	}
+}
+
+func TestMemoryStoreUniqueKey(t *testing.T) {
+	s := NewMemoryStore()
+	if owner, _ := s.ClaimUniqueKey("k", "a", time.Minute); owner != "a" {
+		t.Fatalf("owner=%s", owner)
+	}
+	if owner, _ := s.ClaimUniqueKey("k", "b", time.Minute); owner != "a" {
+		t.Errorf("duplicate claim owner=%s", owner)
+	}
+	s.ReleaseUniqueKey("k", "b")
+	if owner, _ := s.ClaimUniqueKey("k", "b", time.Minute); owner != "a" {
+		t.Errorf("release by a non owner should be ignored, owner=%s", owner)
+	}
+	s.ReleaseUniqueKey("k", "a")
+	if owner, _ := s.ClaimUniqueKey("k", "b", time.Minute); owner != "b" {
+		t.Errorf("owner=%s", owner)
+	}
+	if owner, _ := s.ClaimUniqueKey("expired", "a", 0); owner != "a" {
+		t.Fatalf("owner=%s", owner)
+	}
+	if owner, _ := s.ClaimUniqueKey("expired", "b", time.Minute); owner != "b" {
+		t.Errorf("claim after window owner=%s", owner)
+	}
+}
+
+func TestMemoryStoreCancel(t *testing.T) {
+	s := NewMemoryStore()
+	s.Schedule(newRequest("delay"), 100)
+	s.Enqueue(newRequest("running"))
+	s.Dequeue("w1", allKeys, 10)
+	s.Enqueue(newRequest("ready"))
+	for _, uuid := range []string{"a", "b"} {
+		r := newRequest(uuid)
+		r.OrderKey = "customer-1"
+		s.Enqueue(r)
+	}
+
+	for _, c := range []struct {
+		uuid    string
+		waiting bool
+	}{
+		{"delay", true},
+		{"ready", true},
+		{"running", false},
+		{"b", true},
+		{"unknown", false},
+	} {
+		waiting, err := s.Cancel(c.uuid, time.Minute)
+		if err != nil || waiting != c.waiting {
+			t.Errorf("cancel %s waiting=%v, err=%v", c.uuid, waiting, err)
+		}
+		if cancelled, _ := s.IsCancelled(c.uuid); !cancelled {
+			t.Errorf("%s should be cancelled", c.uuid)
+		}
+	}
+	if uuids, _ := s.PromoteDue(100, 10); len(uuids) != 0 {
+		t.Errorf("cancelled delay task promoted %v", uuids)
+	}
+	if next, _ := s.ReleaseOrderKey("customer-1", "a"); next != "" {
+		t.Errorf("cancelled task should not wait for the order key, next=%s", next)
+	}
+	if _, err := s.GetRequest("running"); err != nil {
+		t.Errorf("running request should be kept, err=%v", err)
+	}
+	if _, err := s.GetRequest("ready"); err != errors.ErrRequestNotExist {
+		t.Errorf("cancelled request should be deleted, err=%v", err)
+	}
+	if uuid, _ := s.Dequeue("w1", allKeys, 10); uuid != "a" {
+		t.Errorf("dequeue uuid=%s, want a", uuid)
+	}
+	if uuid, err := s.Dequeue("w1", allKeys, 10); err != errors.ErrQueueEmpty {
+		t.Errorf("dequeue uuid=%s, err=%v", uuid, err)
+	}
+	if cancelled, _ := s.IsCancelled("a"); cancelled {
+		t.Errorf("a should not be cancelled")
+	}
+}
+
+func TestMemoryStoreRequeueExpired(t *testing.T) {
+	s := NewMemoryStore()
+	s.Enqueue(newRequest("a"))
+	uuid, _ := s.Dequeue("w1", allKeys, 10)
+
+	if uuids, _ := s.RequeueExpired(9); len(uuids) != 0 {
+		t.Fatalf("lease not expired, requeued %v", uuids)
+	}
+	s.ExtendLease("w1", uuid, 20)
+	if uuids, _ := s.RequeueExpired(15); len(uuids) != 0 {
+		t.Fatalf("lease extended, requeued %v", uuids)
+	}
+	uuids, _ := s.RequeueExpired(20)
+	if len(uuids) != 1 || uuids[0] != "a" {
+		t.Fatalf("requeued %v", uuids)
+	}
+	if held, _ := s.Ack("w1", uuid); held {
+		t.Errorf("ack of an expired lease should report false")
+	}
+}
+
+func TestMemoryStoreLateAck(t *testing.T) {
+	s := NewMemoryStore()
+	s.Enqueue(newRequest("a"))
+	uuid, _ := s.Dequeue("w1", allKeys, 10)
+	s.RequeueExpired(10)
+
+	//租约过期后的ack不能删除已被重新投递的任务
+	if held, _ := s.Ack("w1", uuid); held {
+		t.Fatalf("ack of an expired lease should report false")
+	}
+	uuid, _ = s.Dequeue("w2", allKeys, 30)
+	if uuid != "a" {
+		t.Fatalf("requeued task not delivered, got %q", uuid)
+	}
+	if _, err := s.GetRequest(uuid); err != nil {
+		t.Fatalf("request deleted by late ack: %v", err)
+	}
+	if held, _ := s.Ack("w2", uuid); !held {
+		t.Errorf("ack of a held lease should report true")
+	}
+	if _, err := s.GetRequest(uuid); err == nil {
+		t.Errorf("request not deleted by ack")
+	}
+}
+
+func TestMemoryStoreDefer(t *testing.T) {
+	s := NewMemoryStore()
+	s.Enqueue(newRequest("a"))
+	uuid, _ := s.Dequeue("w1", allKeys, 10)
+
+	if held, _ := s.Defer("w2", uuid, 100); held {
+		t.Fatalf("defer by another worker should report false")
+	}
+	if held, _ := s.Defer("w1", uuid, 100); !held {
+		t.Fatalf("defer should report true")
+	}
+	if uuids, _ := s.RequeueExpired(50); len(uuids) != 0 {
+		t.Fatalf("deferred task should not hold a lease, requeued %v", uuids)
+	}
+	if _, err := s.GetRequest("a"); err != nil {
+		t.Fatalf("deferred request should be kept, err=%v", err)
+	}
+	if uuids, _ := s.PromoteDue(99, 10); len(uuids) != 0 {
+		t.Fatalf("promoted %v before start time", uuids)
+	}
+	if uuids, _ := s.PromoteDue(100, 10); len(uuids) != 1 || uuids[0] != "a" {
+		t.Fatalf("promoted %v", uuids)
+	}
+}
+
+func enqueueSlotRequests(s *MemoryStore, uuids ...string) {
+	for _, uuid := range uuids {
+		r := newRequest(uuid)
+		r.ConcurrencyKey = "db"
+		r.ConcurrencyLimit = 2
+		s.Enqueue(r)
+		s.Dequeue("w1", allKeys, 1000)
+	}
+}
+
+func TestMemoryStoreSlot(t *testing.T) {
+	s := NewMemoryStore()
+	enqueueSlotRequests(s, "a", "b", "c", "d")
+	if ok, _ := s.AcquireSlot("w1", "db", "a", 2, 0, 100); !ok {
+		t.Fatalf("acquire a should succeed")
+	}
+	if ok, _ := s.AcquireSlot("w1", "db", "b", 2, 0, 100); !ok {
+		t.Fatalf("acquire b should succeed")
+	}
+	//位置已满，c和d按顺序等待，不再占用租约
+	for _, uuid := range []string{"c", "d"} {
+		if ok, _ := s.AcquireSlot("w1", "db", uuid, 2, 0, 100); ok {
+			t.Fatalf("acquire %s should fail, slots are full", uuid)
+		}
+		if held, _ := s.Ack("w1", uuid); held {
+			t.Fatalf("waiting task %s should not hold a lease", uuid)
+		}
+	}
+	//已占用的任务可以延长
+	if ok, _ := s.AcquireSlot("w1", "db", "a", 2, 0, 200); !ok {
+		t.Fatalf("reacquire a should succeed")
+	}
+	if uuid, err := s.Dequeue("w1", allKeys, 1000); err != errors.ErrQueueEmpty {
+		t.Fatalf("waiting task dequeued uuid=%s, err=%v", uuid, err)
+	}
+
+	//释放的位置交给最早等待的c
+	s.ReleaseSlot("db", "a", 2, 0, 100)
+	if uuid, _ := s.Dequeue("w1", allKeys, 1000); uuid != "c" {
+		t.Fatalf("dequeue uuid=%s, want c", uuid)
+	}
+	if uuid, err := s.Dequeue("w1", allKeys, 1000); err != errors.ErrQueueEmpty {
+		t.Fatalf("dequeue uuid=%s, err=%v", uuid, err)
+	}
+	if ok, _ := s.AcquireSlot("w1", "db", "c", 2, 0, 100); !ok {
+		t.Fatalf("acquire c should use the reserved slot")
+	}
+
+	//取消等待中的任务
+	if waiting, _ := s.Cancel("d", time.Minute); !waiting {
+		t.Fatalf("cancel d should report waiting")
+	}
+	s.ReleaseSlot("db", "b", 2, 0, 100)
+	if uuid, err := s.Dequeue("w1", allKeys, 1000); err != errors.ErrQueueEmpty {
+		t.Fatalf("cancelled task dequeued uuid=%s, err=%v", uuid, err)
+	}
+}
+
+func TestMemoryStoreSlotExpired(t *testing.T) {
+	s := NewMemoryStore()
+	enqueueSlotRequests(s, "a", "b", "c")
+	s.AcquireSlot("w1", "db", "a", 2, 0, 100)
+	s.AcquireSlot("w1", "db", "b", 2, 0, 200)
+	s.AcquireSlot("w1", "db", "c", 2, 0, 100)
+
+	//占用a的worker崩溃，位置随租约过期后交给c
+	if uuids, _ := s.RequeueExpired(99); len(uuids) != 0 {
+		t.Fatalf("slot not expired, requeued %v", uuids)
+	}
+	uuids, _ := s.RequeueExpired(100)
+	if len(uuids) != 1 || uuids[0] != "c" {
+		t.Fatalf("requeued %v", uuids)
+	}
+	if uuid, _ := s.Dequeue("w1", allKeys, 1000); uuid != "c" {
+		t.Fatalf("dequeue uuid=%s, want c", uuid)
+	}
+	if ok, _ := s.AcquireSlot("w1", "db", "c", 2, 100, 300); !ok {
+		t.Fatalf("acquire c should use the reserved slot")
+	}
+	//b过期后释放
+	if ok, _ := s.AcquireSlot("w1", "db", "a", 2, 200, 300); !ok {
+		t.Fatalf("expired slots should be cleared")
+	}
+}
+
+func TestMemoryStoreSchedule(t *testing.T) {
+	s := NewMemoryStore()
+	s.Schedule(newRequest("late"), 200)
+	s.Schedule(newRequest("early"), 100)
+
+	if uuids, _ := s.PromoteDue(99, 10); len(uuids) != 0 {
+		t.Fatalf("promoted %v before due", uuids)
+	}
+	uuids, _ := s.PromoteDue(200, 1)
+	if len(uuids) != 1 || uuids[0] != "early" {
+		t.Fatalf("promoted %v", uuids)
+	}
+	uuids, _ = s.PromoteDue(200, 10)
+	if len(uuids) != 1 || uuids[0] != "late" {
+		t.Fatalf("promoted %v", uuids)
+	}
+	if count, _ := s.UndoCount(task.DefaultQueue); count != 2 {
+		t.Errorf("undo count=%d", count)
+	}
+}
+
+func TestMemoryStoreDelayFIFO(t *testing.T) {
+	s := NewMemoryStore()
+	//同一时刻的任务按提交顺序到期
+	for _, uuid := range []string{"c", "a", "d", "b"} {
+		s.Schedule(newRequest(uuid), 100)
+	}
+	s.Schedule(newRequest("early"), 50)
+
+	delayed, _ := s.Delayed(0, 10)
+	got := make([]string, 0, len(delayed))
+	for _, d := range delayed {
+		got = append(got, d.Uuid)
+	}
+	if strings.Join(got, " ") != "early c a d b" {
+		t.Fatalf("delayed %v", got)
+	}
+	uuids, _ := s.PromoteDue(100, 3)
+	if strings.Join(uuids, " ") != "early c a" {
+		t.Fatalf("promoted %v", uuids)
+	}
+	uuids, _ = s.PromoteDue(100, 10)
+	if strings.Join(uuids, " ") != "d b" {
+		t.Fatalf("promoted %v", uuids)
+	}
+}
+
+func TestMemoryStoreDelayed(t *testing.T) {
+	s := NewMemoryStore()
+	s.Schedule(newRequest("c"), 300)
+	s.Schedule(newRequest("a"), 100)
+	s.Schedule(newRequest("b"), 200)
+
+	if count, _ := s.DelayCount(); count != 3 {
+		t.Fatalf("delay count=%d", count)
+	}
+	delayed, _ := s.Delayed(1, 10)
+	if len(delayed) != 2 || delayed[0].Uuid != "b" || delayed[0].StartTime != 200 || delayed[1].Uuid != "c" {
+		t.Fatalf("delayed %v", delayed)
+	}
+	delayed, _ = s.Delayed(0, 1)
+	if len(delayed) != 1 || delayed[0].Uuid != "a" {
+		t.Fatalf("delayed %v", delayed)
+	}
+	if delayed, _ = s.Delayed(3, 10); len(delayed) != 0 {
+		t.Fatalf("delayed %v", delayed)
+	}
+
+	s.PromoteDue(100, 10)
+	if count, _ := s.DelayCount(); count != 2 {
+		t.Errorf("delay count=%d", count)
+	}
+}
+
+func TestMemoryStoreCronSchedule(t *testing.T) {
+	s := NewMemoryStore()
+	s.SaveSchedule(&task.Schedule{Id: "hourly", Cron: "@hourly", NextTime: 200})
+	s.SaveSchedule(&task.Schedule{Id: "daily", Cron: "@daily", NextTime: 100})
+
+	if ids, _ := s.DueSchedules(99, 10); len(ids) != 0 {
+		t.Fatalf("due %v", ids)
+	}
+	ids, _ := s.DueSchedules(200, 1)
+	if len(ids) != 1 || ids[0] != "daily" {
+		t.Fatalf("due %v", ids)
+	}
+	if ok, _ := s.AdvanceSchedule("daily", 100, 300); !ok {
+		t.Fatalf("advance should succeed")
+	}
+	if ok, _ := s.AdvanceSchedule("daily", 100, 300); ok {
+		t.Errorf("advance of an already advanced schedule should fail")
+	}
+	schedules, _ := s.Schedules()
+	if len(schedules) != 2 || schedules[0].Id != "hourly" || schedules[1].NextTime != 300 {
+		t.Errorf("schedules %+v", schedules)
+	}
+	if ok, _ := s.FinishSchedule("daily", 100); ok {
+		t.Errorf("finish of an already advanced schedule should fail")
+	}
+	if ok, _ := s.FinishSchedule("daily", 300); !ok {
+		t.Fatalf("finish should succeed")
+	}
+	if _, err := s.GetSchedule("daily"); err != errors.ErrScheduleNotExist {
+		t.Errorf("err=%v", err)
+	}
+	s.DeleteSchedule("hourly")
+	if _, err := s.GetSchedule("hourly"); err != errors.ErrScheduleNotExist {
+		t.Errorf("err=%v", err)
+	}
+}
+
+func TestMemoryStoreWorkflow(t *testing.T) {
+	s := NewMemoryStore()
+	w := &task.Workflow{
+		Id: "w1",
+		Nodes: []task.WorkflowNode{
+			{Name: "a", Uuid: "a", State: task.NodeRunning},
+			{Name: "b", Uuid: "b", DependsOn: []string{"a"}, State: task.NodePending},
+		},
+	}
+	s.SaveWorkflow(w)
+	if ok, _ := s.SetWorkflowState("w1", "a", task.NodePending, task.NodeSuccess); ok {
+		t.Errorf("state of a is running, set from pending should fail")
+	}
+	if ok, _ := s.SetWorkflowState("w1", "a", task.NodeRunning, task.NodeSuccess); !ok {
+		t.Errorf("set state should succeed")
+	}
+	got, err := s.GetWorkflow("w1")
+	if err != nil || got.Node("a").State != task.NodeSuccess || got.Node("b").State != task.NodePending {
+		t.Errorf("workflow %+v, err=%v", got, err)
+	}
+	if w.Node("a").State != task.NodeRunning {
+		t.Errorf("saved workflow should be copied")
+	}
+	if _, err := s.GetWorkflow("w2"); err != errors.ErrWorkflowNotExist {
+		t.Errorf("err=%v", err)
+	}
+}
+
+func TestMemoryStoreGroup(t *testing.T) {
+	s := NewMemoryStore()
+	if _, err := s.FinishGroupMember("g1", "a", true); err != errors.ErrGroupNotExist {
+		t.Errorf("err=%v", err)
+	}
+	s.SaveGroup(&task.Group{Id: "g1", Members: []string{"a", "b"}})
+	if done, _ := s.FinishGroupMember("g1", "a", true); done {
+		t.Errorf("group should not be done after one member")
+	}
+	//同一成员重复完成不计数
+	if done, _ := s.FinishGroupMember("g1", "a", false); done {
+		t.Errorf("duplicate member should be ignored")
+	}
+	if done, _ := s.FinishGroupMember("g1", "b", false); !done {
+		t.Errorf("group should be done after the last member")
+	}
+	if done, _ := s.FinishGroupMember("g1", "b", false); done {
+		t.Errorf("group should be done only once")
+	}
+	g, err := s.GetGroup("g1")
+	if err != nil || g.Completed != 1 || g.Failed != 1 || g.State() != task.GroupFailure {
+		t.Errorf("group %+v, err=%v", g, err)
+	}
+}
+
+func TestMemoryStoreResult(t *testing.T) {
+	s := NewMemoryStore()
+	if _, err := s.GetResult("a"); err != errors.ErrResultNotExist {
+		t.Fatalf("err=%v", err)
+	}
+	result := &task.TaskResult{
+		TaskRequest: *newRequest("a"),
+		IsSuccess:   0,
+		Result:      "exec time out",
+	}
+	s.SaveResult(result, time.Minute)
+	s.AddFailed("a")
+	s.AddFailed("a")
+
+	uuid, err := s.PopFailed()
+	if err != nil || uuid != "a" {
+		t.Fatalf("pop failed uuid=%s, err=%v", uuid, err)
+	}
+	if _, err := s.PopFailed(); err != errors.ErrQueueEmpty {
+		t.Errorf("failed set should not hold duplicates, err=%v", err)
+	}
+	r, err := s.GetResult(uuid)
+	if err != nil || r.Result != "exec time out" || r.BinName != "example" {
+		t.Errorf("get result %v, err=%v", r, err)
+	}
+
+	s.AddFinished("a")
+	s.AddFinished("a")
+	if uuid, err := s.PopFinished(); err != nil || uuid != "a" {
+		t.Fatalf("pop finished uuid=%s, err=%v", uuid, err)
+	}
+	if _, err := s.PopFinished(); err != errors.ErrQueueEmpty {
+		t.Errorf("finished set should not hold duplicates, err=%v", err)
+	}
+	//取出后可以再次添加
+	s.AddFinished("a")
+	if uuid, _ := s.PopFinished(); uuid != "a" {
+		t.Errorf("pop finished uuid=%s", uuid)
+	}
+}
+
+func TestMemoryStoreCounter(t *testing.T) {
+	s := NewMemoryStore()
+	s.IncrCounter("c", time.Minute)
+	s.IncrCounter("c", time.Minute)
+	if count, _ := s.GetCounter("c"); count != 2 {
+		t.Errorf("count=%d", count)
+	}
+	if count, _ := s.GetCounter("none"); count != 0 {
+		t.Errorf("count=%d", count)
+	}
+}
+
+func TestMemoryStoreTakeRate(t *testing.T) {
+	s := NewMemoryStore()
+	counters := []RateCounter{
+		{Key: "host", Limit: 3, Expire: time.Minute},
+		{Key: "bin", Limit: 1, Expire: time.Minute},
+	}
+	if full, _ := s.TakeRate(counters); len(full) != 0 {
+		t.Fatalf("full %v", full)
+	}
+	//bin已满，host不计数
+	for i := 0; i < 3; i++ {
+		if full, _ := s.TakeRate(counters); len(full) != 1 || full[0] != 1 {
+			t.Fatalf("full %v", full)
+		}
+	}
+	if count, _ := s.GetCounter("host"); count != 1 {
+		t.Errorf("host count=%d", count)
+	}
+	if full, _ := s.TakeRate(counters[:1]); len(full) != 0 {
+		t.Fatalf("full %v", full)
+	}
+	if count, _ := s.GetCounter("host"); count != 2 {
+		t.Errorf("host count=%d", count)
+	}
+}
+
+func TestMemoryStoreLeader(t *testing.T) {
+	s := NewMemoryStore()
+	if ok, _ := s.AcquireLeader("b1", time.Minute); !ok {
+		t.Fatalf("b1 should become leader")
+	}
+	if ok, _ := s.AcquireLeader("b2", time.Minute); ok {
+		t.Fatalf("b2 should not become leader while b1 holds the lease")
+	}
+	//续约
+	if ok, _ := s.AcquireLeader("b1", time.Minute); !ok {
+		t.Fatalf("b1 should renew its lease")
+	}
+	if id, _ := s.Leader(); id != "b1" {
+		t.Errorf("leader=%s", id)
+	}
+	s.ReleaseLeader("b2")
+	if id, _ := s.Leader(); id != "b1" {
+		t.Errorf("release by b2 should be ignored, leader=%s", id)
+	}
+	s.ReleaseLeader("b1")
+	if ok, _ := s.AcquireLeader("b2", time.Millisecond); !ok {
+		t.Fatalf("b2 should take over after release")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if id, _ := s.Leader(); id != "" {
+		t.Errorf("lease should expire, leader=%s", id)
+	}
+	if ok, _ := s.AcquireLeader("b1", time.Minute); !ok {
+		t.Fatalf("b1 should take over an expired lease")
+	}
+}
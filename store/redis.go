@@ -0,0 +1,1058 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flike/golog"
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+	redis "gopkg.in/redis.v5"
+)
+
+//将任务放入其队列和优先级对应的待执行列表，和ReadyKey一致。
+//指定了order_key的任务，同一个key同时只有一个任务进入待执行列表，
+//其余任务按提交顺序在order_key_list中等待，front为true时放到列表头部。
+//访问的key由任务请求决定，不在KEYS中，见RedisStore
+var pushReadyLua = `
+local function pushReady(uuid, front)
+	local values = redis.call('HMGET', 't_' .. uuid, 'queue', 'priority', 'order_key')
+	local queue, priority, orderKey = values[1], values[2], values[3]
+	if not queue or queue == '' then
+		queue = '` + task.DefaultQueue + `'
+	end
+	if not priority or priority == '' or priority == '0' then
+		priority = '` + strconv.Itoa(task.PriorityNormal) + `'
+	end
+	if orderKey and orderKey ~= '' then
+		local lockKey = '` + config.OrderKeyLockPrefix + `' .. orderKey
+		local holder = redis.call('GET', lockKey)
+		if holder and holder ~= uuid then
+			redis.call('RPUSH', '` + config.OrderKeyListPrefix + `' .. orderKey, uuid)
+			return false
+		end
+		redis.call('SET', lockKey, uuid)
+	end
+	local readyKey = '` + config.RequestUuidListPrefix + `' .. queue .. ':' .. priority
+	if front then
+		redis.call('LPUSH', readyKey, uuid)
+	else
+		redis.call('RPUSH', readyKey, uuid)
+	end
+	return readyKey
+end
+`
+
+//延时集合的score为start_time * 2^21 + 同一时刻内的提交序号，同一时刻的任务按提交顺序到期，
+//序号在start_time之后一天过期
+const delayScoreShift = 1 << 21
+
+//score超过double的精度前能表示的最大start_time
+const maxDelayStartTime = 1 << 32
+
+var delayAddLua = `
+local function delayAdd(key, startTime, uuid)
+	local seqKey = '` + config.DelaySeqPrefix + `' .. startTime
+	local seq = redis.call('INCR', seqKey)
+	redis.call('EXPIREAT', seqKey, startTime + 86400)
+	if seq >= ` + strconv.Itoa(delayScoreShift) + ` then
+		seq = ` + strconv.Itoa(delayScoreShift-1) + `
+	end
+	redis.call('ZADD', key, string.format('%.0f', startTime * ` + strconv.Itoa(delayScoreShift) + ` + seq), uuid)
+end
+`
+
+func delayScore(startTime int64) int64 {
+	return startTime * delayScoreShift
+}
+
+var scheduleScript = redis.NewScript(delayAddLua + `
+delayAdd(KEYS[1], tonumber(ARGV[1]), ARGV[2])
+return 1
+`)
+
+//旧版本的score为start_time，按原顺序改为带提交序号的score
+var migrateDelayScript = redis.NewScript(delayAddLua + `
+local legacy = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1], 'WITHSCORES')
+for i = 1, #legacy, 2 do
+	delayAdd(KEYS[1], tonumber(legacy[i + 1]), legacy[i])
+end
+return #legacy / 2
+`)
+
+//旧版本所有待执行任务在同一个集合中，移入默认队列普通优先级的待执行列表
+var migrateReadyScript = redis.NewScript(`
+local uuids = redis.call('SMEMBERS', KEYS[1])
+for _, uuid in ipairs(uuids) do
+	redis.call('RPUSH', KEYS[2], uuid)
+end
+if #uuids > 0 then
+	redis.call('DEL', KEYS[1])
+	redis.call('SADD', KEYS[3], ARGV[1])
+end
+return #uuids
+`)
+
+var enqueueScript = redis.NewScript(pushReadyLua + `
+return pushReady(ARGV[1], false)
+`)
+
+//将到期的延时任务按执行时刻顺序原子地移入待执行列表
+var promoteScript = redis.NewScript(pushReadyLua + `
+local uuids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, uuid in ipairs(uuids) do
+	redis.call('ZREM', KEYS[1], uuid)
+	pushReady(uuid, false)
+end
+return uuids
+`)
+
+//按顺序从待执行列表头部取出一个任务并放入worker的处理中集合，score为租约到期时刻
+var dequeueScript = redis.NewScript(`
+for i = 3, #KEYS do
+	local uuid = redis.call('LPOP', KEYS[i])
+	if uuid then
+		redis.call('SADD', KEYS[1], ARGV[2])
+		redis.call('ZADD', KEYS[2], ARGV[1], uuid)
+		return uuid
+	end
+end
+return false
+`)
+
+//释放order_key并让等待中的下一个任务进入待执行列表
+var releaseOrderKeyScript = redis.NewScript(pushReadyLua + `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return false
+end
+redis.call('DEL', KEYS[1])
+local next = redis.call('LPOP', KEYS[2])
+if next then
+	pushReady(next, false)
+end
+return next
+`)
+
+//占用幂等key，已被占用时返回占用者
+var claimUniqueKeyScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'EX', ARGV[2]) then
+	return ARGV[1]
+end
+return redis.call('GET', KEYS[1])
+`)
+
+var releaseUniqueKeyScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+//记录取消标记并从所有等待位置移除任务，返回移除的个数，
+//执行中的任务保留请求，由worker完成后删除
+var cancelScript = redis.NewScript(`
+local uuid = ARGV[1]
+redis.call('SET', KEYS[2], 1, 'EX', ARGV[2])
+local values = redis.call('HMGET', 't_' .. uuid, 'queue', 'priority', 'order_key', 'concurrency_key')
+local queue, priority, orderKey, concurrencyKey = values[1], values[2], values[3], values[4]
+if not queue or queue == '' then
+	queue = '` + task.DefaultQueue + `'
+end
+if not priority or priority == '' or priority == '0' then
+	priority = '` + strconv.Itoa(task.PriorityNormal) + `'
+end
+local removed = redis.call('ZREM', KEYS[1], uuid)
+removed = removed + redis.call('LREM', '` + config.RequestUuidListPrefix + `' .. queue .. ':' .. priority, 0, uuid)
+if orderKey and orderKey ~= '' then
+	removed = removed + redis.call('LREM', '` + config.OrderKeyListPrefix + `' .. orderKey, 0, uuid)
+end
+if concurrencyKey and concurrencyKey ~= '' then
+	removed = removed + redis.call('LREM', '` + config.ConcurrencyWaitPrefix + `' .. concurrencyKey, 0, uuid)
+end
+if removed > 0 then
+	redis.call('DEL', 't_' .. uuid)
+end
+return removed
+`)
+
+//仅当下一次触发时刻未被其他broker修改时推进周期任务
+var advanceScheduleScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+redis.call('HSET', KEYS[2], 'next_time', ARGV[3])
+return 1
+`)
+
+//仅当下一次触发时刻未被其他broker修改时删除周期任务
+var finishScheduleScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+//仅当节点状态为ARGV[2]时改为ARGV[3]
+var setWorkflowStateScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+//每个成员只计数一次，最后一个成员完成时返回2
+var finishGroupMemberScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+if redis.call('SADD', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], ARGV[2], 1)
+local done = tonumber(redis.call('HGET', KEYS[1], 'completed')) + tonumber(redis.call('HGET', KEYS[1], 'failed'))
+if done == tonumber(redis.call('HGET', KEYS[1], 'total')) then
+	return 2
+end
+return 1
+`)
+
+//仅当任务仍由该worker持有时延长租约
+var extendLeaseScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+//信号量为有序集合，score为位置的过期时刻。清除过期的位置后，
+//把空出的位置按等待顺序分配给等待列表中的任务，并将它们放回待执行列表头部。
+//limitKey记录有任务等待的concurrency_key和它的concurrency_limit，等待列表为空时删除
+var fillSlotsLua = pushReadyLua + `
+local function fillSlots(slotKey, waitKey, limitKey, name, limit, now, deadline)
+	redis.call('ZREMRANGEBYSCORE', slotKey, '-inf', now)
+	local woken = {}
+	while redis.call('ZCARD', slotKey) < limit do
+		local uuid = redis.call('LPOP', waitKey)
+		if not uuid then
+			break
+		end
+		if redis.call('EXISTS', 't_' .. uuid) == 1 then
+			redis.call('ZADD', slotKey, deadline, uuid)
+			table.insert(woken, uuid)
+		end
+	end
+	if redis.call('LLEN', waitKey) == 0 then
+		redis.call('HDEL', limitKey, name)
+	end
+	for i = #woken, 1, -1 do
+		pushReady(woken[i], true)
+	end
+	return woken
+end
+`
+
+//位置已满或有更早等待的任务时，释放租约并进入等待列表，租约已过期时返回-1
+var acquireSlotScript = redis.NewScript(fillSlotsLua + `
+local limit = tonumber(ARGV[2])
+fillSlots(KEYS[1], KEYS[2], KEYS[3], ARGV[5], limit, ARGV[1], ARGV[4])
+if redis.call('ZSCORE', KEYS[1], ARGV[3]) or redis.call('ZCARD', KEYS[1]) < limit then
+	redis.call('ZADD', KEYS[1], ARGV[4], ARGV[3])
+	return 1
+end
+if redis.call('ZREM', KEYS[4], ARGV[3]) == 0 then
+	return -1
+end
+redis.call('RPUSH', KEYS[2], ARGV[3])
+redis.call('HSET', KEYS[3], ARGV[5], ARGV[2])
+return 0
+`)
+
+var releaseSlotScript = redis.NewScript(fillSlotsLua + `
+redis.call('ZREM', KEYS[1], ARGV[1])
+return fillSlots(KEYS[1], KEYS[2], KEYS[3], ARGV[2], tonumber(ARGV[3]), ARGV[4], ARGV[5])
+`)
+
+//worker崩溃后位置随租约过期，分配给等待中的任务
+var wakeSlotsScript = redis.NewScript(fillSlotsLua + `
+return fillSlots(KEYS[1], KEYS[2], KEYS[3], ARGV[1], tonumber(ARGV[2]), ARGV[3], ARGV[4])
+`)
+
+//ARGV[2i-1]和ARGV[2i]为KEYS[i]的limit和过期秒数，有计数器已满时不计数，返回已满的下标（从0开始）
+var takeRateScript = redis.NewScript(`
+local full = {}
+for i = 1, #KEYS do
+	local count = tonumber(redis.call('GET', KEYS[i]) or '0')
+	if count >= tonumber(ARGV[2 * i - 1]) then
+		table.insert(full, i - 1)
+	end
+end
+if #full > 0 then
+	return full
+end
+for i = 1, #KEYS do
+	if redis.call('INCR', KEYS[i]) == 1 then
+		redis.call('EXPIRE', KEYS[i], ARGV[2 * i])
+	end
+end
+return full
+`)
+
+//租约空闲时获取，已由ARGV[1]持有时续约
+var acquireLeaderScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+var releaseLeaderScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+//租约仍有效时释放租约并删除任务请求
+var ackScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+//租约仍有效时将任务从处理中集合移入延时集合
+var deferScript = redis.NewScript(delayAddLua + `
+if redis.call('ZREM', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+delayAdd(KEYS[2], tonumber(ARGV[1]), ARGV[2])
+return 1
+`)
+
+//将租约过期的任务放回待执行列表头部，worker已无任务时将其注销
+var reapScript = redis.NewScript(pushReadyLua + `
+local uuids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local requeued = {}
+for _, uuid in ipairs(uuids) do
+	redis.call('ZREM', KEYS[1], uuid)
+	if redis.call('EXISTS', 't_' .. uuid) == 1 then
+		pushReady(uuid, true)
+		table.insert(requeued, uuid)
+	end
+end
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('SREM', KEYS[2], ARGV[2])
+end
+return requeued
+`)
+
+//RedisStore需要单个redis节点（可以有slave），不支持redis cluster和按key路由脚本的代理：
+//lua脚本根据任务请求中的队列、优先级和order_key在脚本内拼出t_<uuid>、待执行列表等key，
+//没有全部通过KEYS传入，一个脚本访问的key也不在同一个slot中
+type RedisStore struct {
+	redisAddr   string
+	redisDB     int
+	redisClient *redis.Client
+}
+
+//addr格式为host:port或host:port/db
+func NewRedisStore(addr string) (*RedisStore, error) {
+	var err error
+	s := new(RedisStore)
+
+	vec := strings.SplitN(addr, "/", 2)
+	if len(vec) == 2 {
+		s.redisAddr = vec[0]
+		s.redisDB, err = strconv.Atoi(vec[1])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.redisAddr = vec[0]
+		s.redisDB = config.DefaultRedisDB
+	}
+
+	s.redisClient = redis.NewClient(
+		&redis.Options{
+			Addr:     s.redisAddr,
+			Password: "", // no password set
+			DB:       s.redisDB,
+		},
+	)
+	_, err = s.redisClient.Ping().Result()
+	if err != nil {
+		golog.Error("RedisStore", "NewRedisStore", "ping redis fail", 0, "err", err.Error())
+		return nil, err
+	}
+	err = s.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+//将旧版本写入的数据转换为当前格式，只在第一次启动时有数据需要处理
+func (s *RedisStore) migrate() error {
+	migrated, err := migrateReadyScript.Run(s.redisClient,
+		[]string{config.RequestUuidSet, ReadyKey(task.DefaultQueue, task.PriorityNormal), config.QueueNameSet},
+		task.DefaultQueue,
+	).Result()
+	if err != nil {
+		golog.Error("RedisStore", "migrate", "migrate ready set fail", 0, "err", err.Error())
+		return err
+	}
+	if n, _ := migrated.(int64); n != 0 {
+		golog.Info("RedisStore", "migrate", "migrate ready set", 0, "count", n)
+	}
+
+	migrated, err = migrateDelayScript.Run(s.redisClient,
+		[]string{config.DelayUuidZset},
+		maxDelayStartTime,
+	).Result()
+	if err != nil {
+		golog.Error("RedisStore", "migrate", "migrate delay zset fail", 0, "err", err.Error())
+		return err
+	}
+	if n, _ := migrated.(int64); n != 0 {
+		golog.Info("RedisStore", "migrate", "migrate delay zset", 0, "count", n)
+	}
+	return nil
+}
+
+func requestKey(uuid string) string {
+	return fmt.Sprintf("t_%s", uuid)
+}
+
+func resultKey(uuid string) string {
+	return fmt.Sprintf("r_%s", uuid)
+}
+
+func scheduleKey(id string) string {
+	return fmt.Sprintf("s_%s", id)
+}
+
+func workflowKey(id string) string {
+	return fmt.Sprintf("w_%s", id)
+}
+
+func groupKey(id string) string {
+	return fmt.Sprintf("g_%s", id)
+}
+
+//已完成的成员集合
+func groupDoneKey(id string) string {
+	return fmt.Sprintf("g_done_%s", id)
+}
+
+func slotKey(key string) string {
+	return fmt.Sprintf(config.ConcurrencyKey, key)
+}
+
+func slotWaitKey(key string) string {
+	return config.ConcurrencyWaitPrefix + key
+}
+
+func cancelKey(uuid string) string {
+	return fmt.Sprintf(config.CancelTaskKey, uuid)
+}
+
+func (s *RedisStore) SaveRequest(r *task.TaskRequest) error {
+	key := requestKey(r.Uuid)
+	err := s.redisClient.HMSet(key, task.EncodeRequest(r)).Err()
+	if err != nil {
+		golog.Error("RedisStore", "SaveRequest", "HMSET error", 0,
+			"key", key,
+			"err", err.Error(),
+		)
+		return err
+	}
+	return nil
+}
+
+func (s *RedisStore) GetRequest(uuid string) (*task.TaskRequest, error) {
+	values, err := s.redisClient.HGetAll(requestKey(uuid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	//key不存在
+	if len(values) == 0 {
+		return nil, errors.ErrRequestNotExist
+	}
+	return task.DecodeRequest(values)
+}
+
+func (s *RedisStore) DeleteRequest(uuid string) error {
+	return s.redisClient.Del(requestKey(uuid)).Err()
+}
+
+func (s *RedisStore) Enqueue(r *task.TaskRequest) error {
+	err := s.SaveRequest(r)
+	if err != nil {
+		return err
+	}
+	err = s.addQueue(r.Queue)
+	if err != nil {
+		return err
+	}
+	err = enqueueScript.Run(s.redisClient, nil, r.Uuid).Err()
+	if err != nil && err != redis.Nil {
+		golog.Error("RedisStore", "Enqueue", "enqueue error", 0,
+			"uuid", r.Uuid,
+			"err", err.Error(),
+		)
+		return err
+	}
+	return nil
+}
+
+//延时任务存入redis有序集合，score由执行时刻和提交序号组成，broker重启后不丢失
+func (s *RedisStore) Schedule(r *task.TaskRequest, startTime int64) error {
+	err := s.SaveRequest(r)
+	if err != nil {
+		return err
+	}
+	err = s.addQueue(r.Queue)
+	if err != nil {
+		return err
+	}
+	err = scheduleScript.Run(s.redisClient,
+		[]string{config.DelayUuidZset},
+		startTime, r.Uuid,
+	).Err()
+	if err != nil {
+		golog.Error("RedisStore", "Schedule", "ZADD error", 0,
+			"zset", config.DelayUuidZset,
+			"uuid", r.Uuid,
+			"err", err.Error(),
+		)
+		return err
+	}
+	return nil
+}
+
+func (s *RedisStore) PromoteDue(now int64, limit int) ([]string, error) {
+	//执行时刻不晚于now的所有序号
+	ret, err := promoteScript.Run(s.redisClient,
+		[]string{config.DelayUuidZset},
+		delayScore(now+1)-1, limit,
+	).Result()
+	if err != nil {
+		return nil, err
+	}
+	return toStrings(ret), nil
+}
+
+func (s *RedisStore) Dequeue(workerId string, readyKeys []string, deadline int64) (string, error) {
+	keys := append([]string{config.WorkerIdSet, processingKey(workerId)}, readyKeys...)
+	ret, err := dequeueScript.Run(s.redisClient, keys, deadline, workerId).Result()
+	if err == redis.Nil {
+		return "", errors.ErrQueueEmpty
+	}
+	if err != nil {
+		return "", err
+	}
+	uuid, ok := ret.(string)
+	if !ok {
+		return "", errors.ErrQueueEmpty
+	}
+	return uuid, nil
+}
+
+func (s *RedisStore) ExtendLease(workerId string, uuid string, deadline int64) error {
+	return extendLeaseScript.Run(s.redisClient,
+		[]string{processingKey(workerId)},
+		deadline, uuid,
+	).Err()
+}
+
+func (s *RedisStore) Ack(workerId string, uuid string) (bool, error) {
+	ret, err := ackScript.Run(s.redisClient,
+		[]string{processingKey(workerId), requestKey(uuid)},
+		uuid,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+func (s *RedisStore) AcquireSlot(workerId string, key string, uuid string, limit int, now int64, deadline int64) (bool, error) {
+	ret, err := acquireSlotScript.Run(s.redisClient,
+		[]string{slotKey(key), slotWaitKey(key), config.ConcurrencyWaitHash, processingKey(workerId)},
+		now, limit, uuid, deadline, key,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+func (s *RedisStore) ReleaseSlot(key string, uuid string, limit int, now int64, deadline int64) error {
+	return releaseSlotScript.Run(s.redisClient,
+		[]string{slotKey(key), slotWaitKey(key), config.ConcurrencyWaitHash},
+		uuid, key, limit, now, deadline,
+	).Err()
+}
+
+func (s *RedisStore) Defer(workerId string, uuid string, startTime int64) (bool, error) {
+	ret, err := deferScript.Run(s.redisClient,
+		[]string{processingKey(workerId), config.DelayUuidZset},
+		startTime, uuid,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+func (s *RedisStore) RequeueExpired(now int64) ([]string, error) {
+	workers, err := s.redisClient.SMembers(config.WorkerIdSet).Result()
+	if err != nil {
+		return nil, err
+	}
+	requeued := make([]string, 0)
+	for _, workerId := range workers {
+		ret, err := reapScript.Run(s.redisClient,
+			[]string{processingKey(workerId), config.WorkerIdSet},
+			now, workerId,
+		).Result()
+		if err != nil {
+			golog.Error("RedisStore", "RequeueExpired", "reap error", 0,
+				"worker_id", workerId, "error", err.Error())
+			continue
+		}
+		requeued = append(requeued, toStrings(ret)...)
+	}
+
+	limits, err := s.redisClient.HGetAll(config.ConcurrencyWaitHash).Result()
+	if err != nil {
+		return requeued, err
+	}
+	for key, limit := range limits {
+		ret, err := wakeSlotsScript.Run(s.redisClient,
+			[]string{slotKey(key), slotWaitKey(key), config.ConcurrencyWaitHash},
+			key, limit, now, now+config.DefaultLeaseTime,
+		).Result()
+		if err != nil {
+			golog.Error("RedisStore", "RequeueExpired", "wake slots error", 0,
+				"concurrency_key", key, "error", err.Error())
+			continue
+		}
+		requeued = append(requeued, toStrings(ret)...)
+	}
+	return requeued, nil
+}
+
+func (s *RedisStore) addQueue(queue string) error {
+	if len(queue) == 0 {
+		queue = task.DefaultQueue
+	}
+	return s.redisClient.SAdd(config.QueueNameSet, queue).Err()
+}
+
+func (s *RedisStore) Queues() ([]string, error) {
+	return s.redisClient.SMembers(config.QueueNameSet).Result()
+}
+
+func (s *RedisStore) ClaimUniqueKey(key string, uuid string, window time.Duration) (string, error) {
+	ret, err := claimUniqueKeyScript.Run(s.redisClient,
+		[]string{config.UniqueKeyPrefix + key},
+		uuid, int64(window/time.Second),
+	).Result()
+	if err != nil {
+		return "", err
+	}
+	return toString(ret), nil
+}
+
+func (s *RedisStore) ReleaseUniqueKey(key string, uuid string) error {
+	return releaseUniqueKeyScript.Run(s.redisClient,
+		[]string{config.UniqueKeyPrefix + key},
+		uuid,
+	).Err()
+}
+
+func (s *RedisStore) Cancel(uuid string, keepTime time.Duration) (bool, error) {
+	ret, err := cancelScript.Run(s.redisClient,
+		[]string{config.DelayUuidZset, cancelKey(uuid)},
+		uuid, int64(keepTime/time.Second),
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n > 0, nil
+}
+
+func (s *RedisStore) IsCancelled(uuid string) (bool, error) {
+	return s.redisClient.Exists(cancelKey(uuid)).Result()
+}
+
+func (s *RedisStore) ReleaseOrderKey(orderKey string, uuid string) (string, error) {
+	ret, err := releaseOrderKeyScript.Run(s.redisClient,
+		[]string{config.OrderKeyLockPrefix + orderKey, config.OrderKeyListPrefix + orderKey},
+		uuid,
+	).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return toString(ret), nil
+}
+
+func (s *RedisStore) UndoCount(queue string) (int64, error) {
+	var total int64
+	for _, priority := range task.Priorities {
+		count, err := s.redisClient.LLen(ReadyKey(queue, priority)).Result()
+		if err != nil && err != redis.Nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+func (s *RedisStore) DelayCount() (int64, error) {
+	count, err := s.redisClient.ZCard(config.DelayUuidZset).Result()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *RedisStore) Delayed(offset int, limit int) ([]Delayed, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	members, err := s.redisClient.ZRangeWithScores(config.DelayUuidZset,
+		int64(offset), int64(offset+limit-1)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	delayed := make([]Delayed, 0, len(members))
+	for _, member := range members {
+		delayed = append(delayed, Delayed{
+			Uuid:      toString(member.Member),
+			StartTime: int64(member.Score) / delayScoreShift,
+		})
+	}
+	return delayed, nil
+}
+
+func (s *RedisStore) SaveSchedule(sc *task.Schedule) error {
+	key := scheduleKey(sc.Id)
+	err := s.redisClient.HMSet(key, task.EncodeSchedule(sc)).Err()
+	if err != nil {
+		return err
+	}
+	return s.redisClient.ZAdd(config.ScheduleIdZset, redis.Z{
+		Score:  float64(sc.NextTime),
+		Member: sc.Id,
+	}).Err()
+}
+
+func (s *RedisStore) GetSchedule(id string) (*task.Schedule, error) {
+	values, err := s.redisClient.HGetAll(scheduleKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	//key不存在
+	if len(values) == 0 {
+		return nil, errors.ErrScheduleNotExist
+	}
+	return task.DecodeSchedule(values)
+}
+
+func (s *RedisStore) DeleteSchedule(id string) error {
+	err := s.redisClient.ZRem(config.ScheduleIdZset, id).Err()
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Del(scheduleKey(id)).Err()
+}
+
+func (s *RedisStore) Schedules() ([]*task.Schedule, error) {
+	ids, err := s.redisClient.ZRange(config.ScheduleIdZset, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]*task.Schedule, 0, len(ids))
+	for _, id := range ids {
+		sc, err := s.GetSchedule(id)
+		//已被删除
+		if err == errors.ErrScheduleNotExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, sc)
+	}
+	return schedules, nil
+}
+
+func (s *RedisStore) DueSchedules(now int64, limit int) ([]string, error) {
+	return s.redisClient.ZRangeByScore(config.ScheduleIdZset, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: int64(limit),
+	}).Result()
+}
+
+func (s *RedisStore) AdvanceSchedule(id string, fireTime int64, nextTime int64) (bool, error) {
+	ret, err := advanceScheduleScript.Run(s.redisClient,
+		[]string{config.ScheduleIdZset, scheduleKey(id)},
+		id, fireTime, nextTime,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+func (s *RedisStore) FinishSchedule(id string, fireTime int64) (bool, error) {
+	ret, err := finishScheduleScript.Run(s.redisClient,
+		[]string{config.ScheduleIdZset, scheduleKey(id)},
+		id, fireTime,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+func (s *RedisStore) SaveWorkflow(w *task.Workflow) error {
+	return s.redisClient.HMSet(workflowKey(w.Id), task.EncodeWorkflow(w)).Err()
+}
+
+func (s *RedisStore) GetWorkflow(id string) (*task.Workflow, error) {
+	values, err := s.redisClient.HGetAll(workflowKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	//key不存在
+	if len(values) == 0 {
+		return nil, errors.ErrWorkflowNotExist
+	}
+	return task.DecodeWorkflow(values)
+}
+
+func (s *RedisStore) SetWorkflowState(id string, node string, from string, to string) (bool, error) {
+	ret, err := setWorkflowStateScript.Run(s.redisClient,
+		[]string{workflowKey(id)},
+		task.WorkflowStateField(node), from, to,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+func (s *RedisStore) SaveGroup(g *task.Group) error {
+	return s.redisClient.HMSet(groupKey(g.Id), task.EncodeGroup(g)).Err()
+}
+
+func (s *RedisStore) GetGroup(id string) (*task.Group, error) {
+	values, err := s.redisClient.HGetAll(groupKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.ErrGroupNotExist
+	}
+	return task.DecodeGroup(values)
+}
+
+func (s *RedisStore) FinishGroupMember(id string, uuid string, success bool) (bool, error) {
+	field := "failed"
+	if success {
+		field = "completed"
+	}
+	ret, err := finishGroupMemberScript.Run(s.redisClient,
+		[]string{groupKey(id), groupDoneKey(id)},
+		uuid, field,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	if n == -1 {
+		return false, errors.ErrGroupNotExist
+	}
+	return n == 2, nil
+}
+
+func (s *RedisStore) SaveResult(r *task.TaskResult, keepTime time.Duration) error {
+	key := resultKey(r.Uuid)
+	err := s.redisClient.HMSet(key, task.EncodeResult(r)).Err()
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Expire(key, keepTime).Err()
+}
+
+func (s *RedisStore) GetResult(uuid string) (*task.TaskResult, error) {
+	values, err := s.redisClient.HGetAll(resultKey(uuid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	//key不存在
+	if len(values) == 0 {
+		return nil, errors.ErrResultNotExist
+	}
+	return task.DecodeResult(values)
+}
+
+func (s *RedisStore) DeleteResult(uuid string) error {
+	return s.redisClient.Del(resultKey(uuid)).Err()
+}
+
+func (s *RedisStore) AddFailed(uuid string) error {
+	return s.redisClient.SAdd(config.FailResultUuidSet, uuid).Err()
+}
+
+func (s *RedisStore) PopFailed() (string, error) {
+	uuid, err := s.redisClient.SPop(config.FailResultUuidSet).Result()
+	if err == redis.Nil {
+		return "", errors.ErrQueueEmpty
+	}
+	if err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
+func (s *RedisStore) AddFinished(uuid string) error {
+	return s.redisClient.SAdd(config.FinishResultUuidSet, uuid).Err()
+}
+
+func (s *RedisStore) PopFinished() (string, error) {
+	uuid, err := s.redisClient.SPop(config.FinishResultUuidSet).Result()
+	if err == redis.Nil {
+		return "", errors.ErrQueueEmpty
+	}
+	if err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
+func (s *RedisStore) IncrCounter(key string, expire time.Duration) (int64, error) {
+	count, err := s.redisClient.Incr(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	//第一次设置该key
+	if count == 1 {
+		_, err = s.redisClient.Expire(key, expire).Result()
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (s *RedisStore) GetCounter(key string) (int64, error) {
+	str, err := s.redisClient.Get(key).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(str, 10, 64)
+}
+
+func (s *RedisStore) TakeRate(counters []RateCounter) ([]int, error) {
+	if len(counters) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(counters))
+	args := make([]interface{}, 0, 2*len(counters))
+	for _, c := range counters {
+		keys = append(keys, c.Key)
+		args = append(args, c.Limit, int64(c.Expire/time.Second))
+	}
+	ret, err := takeRateScript.Run(s.redisClient, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	values, _ := ret.([]interface{})
+	full := make([]int, 0, len(values))
+	for _, v := range values {
+		i, _ := v.(int64)
+		full = append(full, int(i))
+	}
+	return full, nil
+}
+
+func (s *RedisStore) AcquireLeader(id string, lease time.Duration) (bool, error) {
+	ret, err := acquireLeaderScript.Run(s.redisClient,
+		[]string{config.BrokerLeaderKey},
+		id, int64(lease/time.Millisecond),
+	).Result()
+	if err != nil {
+		return false, err
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+func (s *RedisStore) ReleaseLeader(id string) error {
+	return releaseLeaderScript.Run(s.redisClient,
+		[]string{config.BrokerLeaderKey},
+		id,
+	).Err()
+}
+
+func (s *RedisStore) Leader() (string, error) {
+	id, err := s.redisClient.Get(config.BrokerLeaderKey).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return id, err
+}
+
+func (s *RedisStore) Close() error {
+	return s.redisClient.Close()
+}
+
+func processingKey(workerId string) string {
+	return fmt.Sprintf(config.ProcessingUuidZset, workerId)
+}
+
+func toString(v interface{}) string {
+	str, _ := v.(string)
+	return str
+}
+
+func toStrings(v interface{}) []string {
+	values, _ := v.([]interface{})
+	ret := make([]string, 0, len(values))
+	for _, value := range values {
+		ret = append(ret, toString(value))
+	}
+	return ret
+}
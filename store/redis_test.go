@@ -0,0 +1,116 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/task"
+)
+
+//需要redis，通过KINGTASK_TEST_REDIS指定地址，例如127.0.0.1:6379/15
+func newTestRedisStore(t *testing.T) *RedisStore {
+	addr := os.Getenv("KINGTASK_TEST_REDIS")
+	if len(addr) == 0 {
+		t.Skip("KINGTASK_TEST_REDIS not set")
+	}
+	s, err := NewRedisStore(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRedisStoreMigrateReadySet(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	//旧版本写入的任务请求和待执行集合
+	uuid := "legacy-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	err := s.redisClient.HMSet(requestKey(uuid), map[string]string{
+		"uuid":          uuid,
+		"bin_name":      "example",
+		"args":          "",
+		"start_time":    "0",
+		"time_interval": "",
+		"index":         "0",
+		"max_run_time":  "0",
+		"task_type":     "1",
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.DeleteRequest(uuid)
+	err = s.redisClient.SAdd(config.RequestUuidSet, uuid).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.redisClient.SCard(config.RequestUuidSet).Result(); n != 0 {
+		t.Errorf("legacy set has %d members", n)
+	}
+	readyKey := ReadyKey(task.DefaultQueue, task.PriorityNormal)
+	if n, _ := s.redisClient.LRem(readyKey, 0, uuid).Result(); n != 1 {
+		t.Fatalf("%s not moved to %s", uuid, readyKey)
+	}
+	r, err := s.GetRequest(uuid)
+	if err != nil || r.BinName != "example" || r.Queue != task.DefaultQueue {
+		t.Errorf("request %+v, err=%v", r, err)
+	}
+}
+
+func TestRedisStoreSlotHandover(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	prefix := "slot-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	key := prefix + "-db"
+	queue := prefix + "-queue"
+	keys := []string{ReadyKey(queue, task.PriorityNormal)}
+	defer s.redisClient.Del(slotKey(key), slotWaitKey(key))
+	for _, id := range []string{"a", "b"} {
+		r := &task.TaskRequest{
+			Uuid:             prefix + "-" + id,
+			BinName:          "example",
+			TaskType:         task.ScriptTask,
+			Queue:            queue,
+			ConcurrencyKey:   key,
+			ConcurrencyLimit: 1,
+		}
+		if err := s.Enqueue(r); err != nil {
+			t.Fatal(err)
+		}
+		defer s.DeleteRequest(r.Uuid)
+		if uuid, err := s.Dequeue("w1", keys, 1000); err != nil || uuid != r.Uuid {
+			t.Fatalf("dequeue uuid=%s, err=%v", uuid, err)
+		}
+	}
+	a, b := prefix+"-a", prefix+"-b"
+	if ok, err := s.AcquireSlot("w1", key, a, 1, 0, 100); err != nil || !ok {
+		t.Fatalf("acquire a ok=%v, err=%v", ok, err)
+	}
+	if ok, err := s.AcquireSlot("w1", key, b, 1, 0, 100); err != nil || ok {
+		t.Fatalf("acquire b ok=%v, err=%v", ok, err)
+	}
+	if uuid, err := s.Dequeue("w1", keys, 1000); err != errors.ErrQueueEmpty {
+		t.Fatalf("waiting task dequeued uuid=%s, err=%v", uuid, err)
+	}
+	if err := s.ReleaseSlot(key, a, 1, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if uuid, err := s.Dequeue("w1", keys, 1000); err != nil || uuid != b {
+		t.Fatalf("dequeue uuid=%s, err=%v, want %s", uuid, err, b)
+	}
+	if ok, err := s.AcquireSlot("w1", key, b, 1, 0, 100); err != nil || !ok {
+		t.Fatalf("acquire b ok=%v, err=%v", ok, err)
+	}
+	s.Ack("w1", a)
+	s.Ack("w1", b)
+}
@@ -0,0 +1,151 @@
+//storage backend shared by broker and worker
+package store
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/task"
+)
+
+//指定队列和优先级的待执行列表
+func ReadyKey(queue string, priority int) string {
+	if len(queue) == 0 {
+		queue = task.DefaultQueue
+	}
+	if priority == 0 {
+		priority = task.PriorityNormal
+	}
+	return config.RequestUuidListPrefix + queue + ":" + strconv.Itoa(priority)
+}
+
+//延时集合中的任务和它进入待执行队列的时刻
+type Delayed struct {
+	Uuid      string
+	StartTime int64
+}
+
+//固定窗口的限流计数器，第一次计数后expire过期
+type RateCounter struct {
+	Key    string
+	Limit  int64
+	Expire time.Duration
+}
+
+//Store封装broker和worker对任务存储的所有访问，
+//默认使用redis实现，MemoryStore用于测试和嵌入式运行
+type Store interface {
+	//保存任务请求
+	SaveRequest(r *task.TaskRequest) error
+	//获取任务请求，不存在时返回ErrRequestNotExist
+	GetRequest(uuid string) (*task.TaskRequest, error)
+	DeleteRequest(uuid string) error
+
+	//保存任务请求并放入待执行队列
+	Enqueue(r *task.TaskRequest) error
+	//保存任务请求，到startTime时刻再放入待执行队列
+	Schedule(r *task.TaskRequest, startTime int64) error
+	//将到期的延时任务移入待执行队列，返回被移动的uuid
+	PromoteDue(now int64, limit int) ([]string, error)
+	//按readyKeys的顺序取出一个任务并由workerId持有租约直到deadline，
+	//所有队列为空时返回ErrQueueEmpty
+	Dequeue(workerId string, readyKeys []string, deadline int64) (string, error)
+	//任务到达最终状态后释放order_key，返回随后进入待执行队列的任务uuid，没有则返回空
+	ReleaseOrderKey(orderKey string, uuid string) (string, error)
+	//在window内占用幂等key，返回占用该key的任务uuid，
+	//key已被其他任务占用时返回该任务的uuid
+	ClaimUniqueKey(key string, uuid string, window time.Duration) (string, error)
+	//释放uuid占用的幂等key
+	ReleaseUniqueKey(key string, uuid string) error
+	//取消任务：记录取消标记，keepTime后过期，任务处于等待执行状态时
+	//从延时集合、待执行列表和order_key等待列表中移除并删除请求，返回任务是否处于等待执行状态
+	Cancel(uuid string, keepTime time.Duration) (bool, error)
+	//任务是否已被取消
+	IsCancelled(uuid string) (bool, error)
+	//延长workerId持有的租约，租约已失效时不做任何操作
+	ExtendLease(workerId string, uuid string, deadline int64) error
+	//确认任务完成，释放租约并删除任务请求，租约已过期时任务可能已被重新投递，
+	//不做任何操作并返回false
+	Ack(workerId string, uuid string) (bool, error)
+	//在concurrency_key的信号量中为uuid占用一个位置直到deadline，已占用时更新deadline。
+	//先清除now之前过期的位置（例如worker崩溃）并分配给等待中的任务，位置已满时释放租约，
+	//任务进入该concurrency_key的等待列表并返回false
+	AcquireSlot(workerId string, key string, uuid string, limit int, now int64, deadline int64) (bool, error)
+	//释放uuid占用的位置，按等待顺序把空出的位置交给等待中的任务（占用到deadline）并放回待执行队列
+	ReleaseSlot(key string, uuid string, limit int, now int64, deadline int64) error
+	//释放租约但保留任务请求，到startTime时刻再放入待执行队列，租约已过期时不做任何操作并返回false
+	Defer(workerId string, uuid string, startTime int64) (bool, error)
+	//将租约过期的任务重新放入待执行队列，并把随租约过期空出的并发位置分配给等待中的任务，返回被重新投递的uuid
+	RequeueExpired(now int64) ([]string, error)
+	//指定队列中待执行任务个数
+	UndoCount(queue string) (int64, error)
+	//延时集合中的任务个数，包括重试和推迟执行的任务
+	DelayCount() (int64, error)
+	//按执行时刻从早到晚，返回延时集合中从第offset个开始的最多limit个任务
+	Delayed(offset int, limit int) ([]Delayed, error)
+	//所有提交过任务的队列
+	Queues() ([]string, error)
+
+	//保存周期任务，按NextTime触发
+	SaveSchedule(s *task.Schedule) error
+	//获取周期任务，不存在时返回ErrScheduleNotExist
+	GetSchedule(id string) (*task.Schedule, error)
+	DeleteSchedule(id string) error
+	//按下一次触发时刻排序的所有周期任务
+	Schedules() ([]*task.Schedule, error)
+	//到期的周期任务id
+	DueSchedules(now int64, limit int) ([]string, error)
+	//仅当周期任务的下一次触发时刻仍为fireTime时将其改为nextTime，
+	//多个broker同时处理时只有一个返回true
+	AdvanceSchedule(id string, fireTime int64, nextTime int64) (bool, error)
+	//仅当周期任务的下一次触发时刻仍为fireTime时将其删除，用于最后一次触发
+	FinishSchedule(id string, fireTime int64) (bool, error)
+
+	//保存工作流的定义和所有节点的状态
+	SaveWorkflow(w *task.Workflow) error
+	//获取工作流，不存在时返回ErrWorkflowNotExist
+	GetWorkflow(id string) (*task.Workflow, error)
+	//仅当节点状态为from时改为to，返回是否修改
+	SetWorkflowState(id string, node string, from string, to string) (bool, error)
+
+	//保存任务组的成员和回调任务
+	SaveGroup(g *task.Group) error
+	//获取任务组，不存在时返回ErrGroupNotExist
+	GetGroup(id string) (*task.Group, error)
+	//记录成员到达最终状态，同一成员只记录一次，
+	//返回本次记录后是否所有成员都已到达最终状态
+	FinishGroupMember(id string, uuid string, success bool) (bool, error)
+
+	//保存任务结果，keepTime后过期
+	SaveResult(r *task.TaskResult, keepTime time.Duration) error
+	//获取任务结果，不存在时返回ErrResultNotExist
+	GetResult(uuid string) (*task.TaskResult, error)
+	DeleteResult(uuid string) error
+
+	//失败任务集合
+	AddFailed(uuid string) error
+	//取出一个失败任务，集合为空时返回ErrQueueEmpty
+	PopFailed() (string, error)
+	//已到达最终状态、需要broker继续处理的任务集合，见TaskRequest.HasFinishHook
+	AddFinished(uuid string) error
+	PopFinished() (string, error)
+
+	//计数器加一，第一次设置时expire后过期
+	IncrCounter(key string, expire time.Duration) (int64, error)
+	//获取计数器的值，不存在时返回0
+	GetCounter(key string) (int64, error)
+	//原子地检查所有限流计数器，都小于各自的Limit时全部加一并返回空，
+	//否则不修改任何计数器，返回已满的计数器在counters中的下标
+	TakeRate(counters []RateCounter) ([]int, error)
+
+	//获取或续约leader租约，租约空闲或已由id持有时返回true，
+	//多个broker中只有持有租约的一个运行调度、重试和延时任务
+	AcquireLeader(id string, lease time.Duration) (bool, error)
+	//id持有租约时释放，其他broker可以立即接管
+	ReleaseLeader(id string) error
+	//当前持有租约的broker，没有时返回空
+	Leader() (string, error)
+
+	Close() error
+}
@@ -0,0 +1,329 @@
+package task
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/the-no/kingtask/core/errors"
+)
+
+//存储格式版本，新增字段时无需修改，字段含义变化时递增并在decode中兼容旧版本，
+//没有version字段的数据为版本0，即最初的8个字段格式，
+//比CodecVersion新的数据由更新版本的程序写入，解码时返回ErrCodecVersion
+const CodecVersion = 1
+
+const versionField = "version"
+
+//将TaskRequest编码为存储的字段表（redis hash）
+func EncodeRequest(r *TaskRequest) map[string]string {
+	m := make(map[string]string)
+	encodeRequest(r, m)
+	return m
+}
+
+//从存储的字段表解码TaskRequest，缺少的字段保持零值，未知字段忽略
+func DecodeRequest(m map[string]string) (*TaskRequest, error) {
+	r := new(TaskRequest)
+	d := &decoder{m: m}
+	decodeRequest(d, r)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return r, nil
+}
+
+//将TaskResult编码为存储的字段表，包含请求的所有字段
+func EncodeResult(r *TaskResult) map[string]string {
+	m := make(map[string]string)
+	encodeRequest(&r.TaskRequest, m)
+	m["is_success"] = strconv.FormatInt(r.IsSuccess, 10)
+	m["result"] = r.Result
+	m["state"] = r.State
+	m["error_class"] = r.ErrorClass
+	m["error_code"] = strconv.Itoa(r.ErrorCode)
+	return m
+}
+
+func DecodeResult(m map[string]string) (*TaskResult, error) {
+	r := new(TaskResult)
+	d := &decoder{m: m}
+	decodeRequest(d, &r.TaskRequest)
+	r.IsSuccess = d.int64("is_success")
+	r.Result = d.str("result")
+	r.State = d.str("state")
+	r.ErrorClass = d.str("error_class")
+	r.ErrorCode = d.int("error_code")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return r, nil
+}
+
+//周期任务的模板请求和调度字段保存在同一个字段表中
+func EncodeSchedule(s *Schedule) map[string]string {
+	m := make(map[string]string)
+	encodeRequest(&s.Request, m)
+	m["id"] = s.Id
+	m["cron"] = s.Cron
+	m["next_time"] = strconv.FormatInt(s.NextTime, 10)
+	return m
+}
+
+func DecodeSchedule(m map[string]string) (*Schedule, error) {
+	s := new(Schedule)
+	d := &decoder{m: m}
+	decodeRequest(d, &s.Request)
+	s.Id = d.str("id")
+	s.Cron = d.str("cron")
+	s.NextTime = d.int64("next_time")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return s, nil
+}
+
+//工作流的每个节点保存为node:、uuid:、depends_on:和state:开头的字段
+func EncodeWorkflow(w *Workflow) map[string]string {
+	m := make(map[string]string)
+	m[versionField] = strconv.Itoa(CodecVersion)
+	m["id"] = w.Id
+	names := make([]string, 0, len(w.Nodes))
+	for _, node := range w.Nodes {
+		names = append(names, node.Name)
+		m["uuid:"+node.Name] = node.Uuid
+		m["depends_on:"+node.Name] = strings.Join(node.DependsOn, " ")
+		m[WorkflowStateField(node.Name)] = node.State
+	}
+	m["nodes"] = strings.Join(names, " ")
+	return m
+}
+
+func DecodeWorkflow(m map[string]string) (*Workflow, error) {
+	d := &decoder{m: m}
+	version := d.version()
+	if d.err != nil {
+		return nil, d.err
+	}
+	w := new(Workflow)
+	switch version {
+	case 0:
+		//工作流在版本1才加入，没有version字段的数据按版本1的格式解析
+		fallthrough
+	case 1:
+		w.Id = d.str("id")
+		for _, name := range strings.Fields(d.str("nodes")) {
+			w.Nodes = append(w.Nodes, WorkflowNode{
+				Name:      name,
+				Uuid:      d.str("uuid:" + name),
+				DependsOn: strings.Fields(d.str("depends_on:" + name)),
+				State:     d.str(WorkflowStateField(name)),
+			})
+		}
+	}
+	return w, nil
+}
+
+//任务组的计数字段由store单独累加
+func EncodeGroup(g *Group) map[string]string {
+	m := make(map[string]string)
+	m[versionField] = strconv.Itoa(CodecVersion)
+	m["id"] = g.Id
+	m["members"] = strings.Join(g.Members, " ")
+	m["total"] = strconv.Itoa(len(g.Members))
+	m["completed"] = strconv.FormatInt(g.Completed, 10)
+	m["failed"] = strconv.FormatInt(g.Failed, 10)
+	m["callback"] = encodeFollowUp(g.Callback)
+	return m
+}
+
+func DecodeGroup(m map[string]string) (*Group, error) {
+	g := new(Group)
+	d := &decoder{m: m}
+	//任务组在版本1才加入，各版本格式相同
+	d.version()
+	g.Id = d.str("id")
+	g.Members = strings.Fields(d.str("members"))
+	g.Completed = d.int64("completed")
+	g.Failed = d.int64("failed")
+	g.Callback = d.followUp("callback")
+	if d.err != nil {
+		return nil, d.err
+	}
+	return g, nil
+}
+
+//节点状态所在的字段，用于单独修改节点状态
+func WorkflowStateField(name string) string {
+	return "state:" + name
+}
+
+func encodeRequest(r *TaskRequest, m map[string]string) {
+	m[versionField] = strconv.Itoa(CodecVersion)
+	m["uuid"] = r.Uuid
+	m["bin_name"] = r.BinName
+	m["args"] = r.Args
+	m["start_time"] = strconv.FormatInt(r.StartTime, 10)
+	m["time_interval"] = r.TimeInterval
+	m["index"] = strconv.Itoa(r.Index)
+	m["max_run_time"] = strconv.FormatInt(r.MaxRunTime, 10)
+	m["task_type"] = strconv.Itoa(r.TaskType)
+	m["priority"] = strconv.Itoa(r.Priority)
+	m["queue"] = r.Queue
+	m["order_key"] = r.OrderKey
+	m["unique_key"] = r.UniqueKey
+	m["timezone"] = r.Timezone
+	m["windows"] = r.Windows
+	m["calendars"] = r.Calendars
+	m["retry_strategy"] = r.Retry.Strategy
+	m["retry_base_delay"] = strconv.FormatInt(r.Retry.BaseDelay, 10)
+	m["retry_multiplier"] = strconv.FormatFloat(r.Retry.Multiplier, 'g', -1, 64)
+	m["retry_max_delay"] = strconv.FormatInt(r.Retry.MaxDelay, 10)
+	m["retry_jitter"] = strconv.FormatFloat(r.Retry.Jitter, 'g', -1, 64)
+	m["retry_max_attempts"] = strconv.Itoa(r.Retry.MaxAttempts)
+	m["retry_on"] = r.RetryOn
+	m["workflow"] = r.Workflow
+	m["workflow_node"] = r.WorkflowNode
+	m["group"] = r.Group
+	m["rate_key"] = r.RateKey
+	m["concurrency_key"] = r.ConcurrencyKey
+	m["concurrency_limit"] = strconv.Itoa(r.ConcurrencyLimit)
+	m["expires_at"] = strconv.FormatInt(r.ExpiresAt, 10)
+	m["ttl"] = strconv.FormatInt(r.TTL, 10)
+	m["on_success"] = encodeFollowUp(r.OnSuccess)
+	m["on_failure"] = encodeFollowUp(r.OnFailure)
+	m["parent_uuid"] = r.ParentUuid
+	m["parent_state"] = r.ParentState
+	m["parent_result"] = r.ParentResult
+}
+
+//后续任务以json保存在一个字段中
+func encodeFollowUp(r *TaskRequest) string {
+	if r == nil {
+		return ""
+	}
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+func decodeRequest(d *decoder, r *TaskRequest) {
+	version := d.version()
+	if d.err != nil {
+		return
+	}
+	//各版本共有的最初8个字段
+	r.Uuid = d.str("uuid")
+	r.BinName = d.str("bin_name")
+	r.Args = d.str("args")
+	r.StartTime = d.int64("start_time")
+	r.TimeInterval = d.str("time_interval")
+	r.Index = d.int("index")
+	r.MaxRunTime = d.int64("max_run_time")
+	r.TaskType = d.int("task_type")
+	switch version {
+	case 0:
+		//版本0没有优先级和队列，按普通优先级放入默认队列
+		r.Priority = PriorityNormal
+		r.Queue = DefaultQueue
+	case 1:
+		decodeRequestV1(d, r)
+	}
+}
+
+//版本1在最初8个字段之后加入的字段
+func decodeRequestV1(d *decoder, r *TaskRequest) {
+	r.Priority = d.int("priority")
+	if r.Priority == 0 {
+		r.Priority = PriorityNormal
+	}
+	r.Queue = d.str("queue")
+	if len(r.Queue) == 0 {
+		r.Queue = DefaultQueue
+	}
+	r.OrderKey = d.str("order_key")
+	r.UniqueKey = d.str("unique_key")
+	r.Timezone = d.str("timezone")
+	r.Windows = d.str("windows")
+	r.Calendars = d.str("calendars")
+	r.Retry.Strategy = d.str("retry_strategy")
+	r.Retry.BaseDelay = d.int64("retry_base_delay")
+	r.Retry.Multiplier = d.float64("retry_multiplier")
+	r.Retry.MaxDelay = d.int64("retry_max_delay")
+	r.Retry.Jitter = d.float64("retry_jitter")
+	r.Retry.MaxAttempts = d.int("retry_max_attempts")
+	r.RetryOn = d.str("retry_on")
+	r.Workflow = d.str("workflow")
+	r.WorkflowNode = d.str("workflow_node")
+	r.Group = d.str("group")
+	r.RateKey = d.str("rate_key")
+	r.ConcurrencyKey = d.str("concurrency_key")
+	r.ConcurrencyLimit = d.int("concurrency_limit")
+	r.ExpiresAt = d.int64("expires_at")
+	r.TTL = d.int64("ttl")
+	r.OnSuccess = d.followUp("on_success")
+	r.OnFailure = d.followUp("on_failure")
+	r.ParentUuid = d.str("parent_uuid")
+	r.ParentState = d.str("parent_state")
+	r.ParentResult = d.str("parent_result")
+}
+
+//decoder记录第一个解析错误，避免每个字段都判断错误
+type decoder struct {
+	m   map[string]string
+	err error
+}
+
+//存储格式版本，没有version字段时为0
+func (d *decoder) version() int {
+	version := d.int(versionField)
+	if d.err == nil && (version < 0 || CodecVersion < version) {
+		d.err = errors.ErrCodecVersion
+	}
+	return version
+}
+
+func (d *decoder) str(field string) string {
+	return d.m[field]
+}
+
+func (d *decoder) int64(field string) int64 {
+	v, ok := d.m[field]
+	if !ok || len(v) == 0 || d.err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		d.err = err
+	}
+	return n
+}
+
+func (d *decoder) int(field string) int {
+	return int(d.int64(field))
+}
+
+func (d *decoder) float64(field string) float64 {
+	v, ok := d.m[field]
+	if !ok || len(v) == 0 || d.err != nil {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		d.err = err
+	}
+	return f
+}
+
+func (d *decoder) followUp(field string) *TaskRequest {
+	v := d.m[field]
+	if len(v) == 0 || d.err != nil {
+		return nil
+	}
+	r := new(TaskRequest)
+	err := json.Unmarshal([]byte(v), r)
+	if err != nil {
+		d.err = err
+		return nil
+	}
+	return r
+}
@@ -0,0 +1,225 @@
+package task
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/the-no/kingtask/core/errors"
+)
+
+func TestRequestCodec(t *testing.T) {
+	r := &TaskRequest{
+		Uuid:         "a",
+		BinName:      "example",
+		Args:         "1 2",
+		StartTime:    1445562622,
+		TimeInterval: "60 600",
+		Index:        1,
+		MaxRunTime:   30,
+		TaskType:     ScriptTask,
+		Priority:     PriorityHigh,
+		Queue:        "heavy",
+		OrderKey:     "customer-1",
+		UniqueKey:    "export-2015-10-30",
+		Timezone:     "Europe/Berlin",
+		Windows:      "01:00-05:00",
+		Calendars:    "holidays-de",
+		Retry: RetryPolicy{
+			Strategy:    RetryExponential,
+			BaseDelay:   60,
+			Multiplier:  1.5,
+			MaxDelay:    3600,
+			Jitter:      0.1,
+			MaxAttempts: 10,
+		},
+		RetryOn:          "timeout http_status:5xx",
+		Workflow:         "w1",
+		WorkflowNode:     "extract",
+		Group:            "g1",
+		RateKey:          "partner-api",
+		ConcurrencyKey:   "customer-1",
+		ConcurrencyLimit: 2,
+		ExpiresAt:        1445566222,
+		TTL:              3600,
+		OnSuccess: &TaskRequest{
+			BinName:  "http://127.0.0.1/notify",
+			TaskType: RpcTaskPOST,
+			Retry:    RetryPolicy{Strategy: RetryFixed, BaseDelay: 10},
+		},
+		OnFailure:    &TaskRequest{BinName: "cleanup", TaskType: ScriptTask},
+		ParentUuid:   "p",
+		ParentState:  StateSuccess,
+		ParentResult: "line1\nline2",
+	}
+	m := EncodeRequest(r)
+	if m["version"] != "1" {
+		t.Errorf("version=%s", m["version"])
+	}
+	got, err := DecodeRequest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("decode %+v, want %+v", got, r)
+	}
+}
+
+func TestDecodeLegacyRequest(t *testing.T) {
+	//没有version字段的旧格式
+	m := map[string]string{
+		"uuid":          "a",
+		"bin_name":      "example",
+		"args":          "",
+		"start_time":    "1445562622",
+		"time_interval": "",
+		"index":         "0",
+		"max_run_time":  "0",
+		"task_type":     "1",
+		"unknown":       "ignored",
+	}
+	r, err := DecodeRequest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Uuid != "a" || r.StartTime != 1445562622 || r.TaskType != ScriptTask ||
+		r.Priority != PriorityNormal || r.Queue != DefaultQueue {
+		t.Errorf("decode %+v", r)
+	}
+
+	//版本0没有后续任务字段
+	m["on_success"] = "{"
+	if r, err := DecodeRequest(m); err != nil || r.OnSuccess != nil {
+		t.Errorf("decode version 0 %+v, err %v", r, err)
+	}
+	m[versionField] = "1"
+	if _, err := DecodeRequest(m); err == nil {
+		t.Errorf("decode invalid on_success should fail")
+	}
+	delete(m, "on_success")
+	m["index"] = "x"
+	if _, err := DecodeRequest(m); err == nil {
+		t.Errorf("decode invalid index should fail")
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	//版本0忽略之后加入的字段
+	m := map[string]string{
+		"uuid":     "a",
+		"priority": "3",
+		"queue":    "heavy",
+	}
+	r, err := DecodeRequest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Priority != PriorityNormal || r.Queue != DefaultQueue {
+		t.Errorf("decode version 0 %+v", r)
+	}
+	m[versionField] = "1"
+	r, err = DecodeRequest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Priority != PriorityHigh || r.Queue != "heavy" {
+		t.Errorf("decode version 1 %+v", r)
+	}
+
+	//更新版本的程序写入的数据
+	m[versionField] = strconv.Itoa(CodecVersion + 1)
+	if _, err := DecodeRequest(m); err != errors.ErrCodecVersion {
+		t.Errorf("decode newer request err %v", err)
+	}
+	if _, err := DecodeResult(m); err != errors.ErrCodecVersion {
+		t.Errorf("decode newer result err %v", err)
+	}
+	w := EncodeWorkflow(&Workflow{Id: "w1", Nodes: []WorkflowNode{{Name: "a"}}})
+	w[versionField] = strconv.Itoa(CodecVersion + 1)
+	if _, err := DecodeWorkflow(w); err != errors.ErrCodecVersion {
+		t.Errorf("decode newer workflow err %v", err)
+	}
+	g := EncodeGroup(&Group{Id: "g1"})
+	g[versionField] = strconv.Itoa(CodecVersion + 1)
+	if _, err := DecodeGroup(g); err != errors.ErrCodecVersion {
+		t.Errorf("decode newer group err %v", err)
+	}
+
+	//没有version字段的工作流
+	delete(w, versionField)
+	if wf, err := DecodeWorkflow(w); err != nil || wf.Id != "w1" || len(wf.Nodes) != 1 {
+		t.Errorf("decode version 0 workflow %+v, err %v", wf, err)
+	}
+}
+
+func TestScheduleCodec(t *testing.T) {
+	s := &Schedule{
+		Id:       "s1",
+		Cron:     "0 2 * * *",
+		Request:  TaskRequest{BinName: "report", Args: "daily", TaskType: ScriptTask, Priority: PriorityHigh, Queue: DefaultQueue},
+		NextTime: 1446170400,
+	}
+	got, err := DecodeSchedule(EncodeSchedule(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("decode %+v, want %+v", got, s)
+	}
+}
+
+func TestWorkflowCodec(t *testing.T) {
+	w := &Workflow{
+		Id: "w1",
+		Nodes: []WorkflowNode{
+			{Name: "extract", Uuid: "a", DependsOn: []string{}, State: NodeSuccess},
+			{Name: "load", Uuid: "b", DependsOn: []string{"extract"}, State: NodeRunning},
+		},
+	}
+	got, err := DecodeWorkflow(EncodeWorkflow(w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, w) {
+		t.Errorf("decode %+v, want %+v", got, w)
+	}
+}
+
+func TestGroupCodec(t *testing.T) {
+	g := &Group{
+		Id:        "g1",
+		Members:   []string{"a", "b", "c"},
+		Completed: 1,
+		Failed:    1,
+		Callback:  &TaskRequest{BinName: "merge", TaskType: ScriptTask},
+	}
+	m := EncodeGroup(g)
+	if m["total"] != "3" {
+		t.Errorf("total=%s", m["total"])
+	}
+	got, err := DecodeGroup(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, g) {
+		t.Errorf("decode %+v, want %+v", got, g)
+	}
+}
+
+func TestResultCodec(t *testing.T) {
+	r := &TaskResult{
+		TaskRequest: TaskRequest{Uuid: "a", TaskType: RpcTaskPOST, Priority: PriorityLow, Queue: "rpc"},
+		IsSuccess:   0,
+		Result:      "service unavailable",
+		State:       StateFailure,
+		ErrorClass:  "http_status",
+		ErrorCode:   503,
+	}
+	got, err := DecodeResult(EncodeResult(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("decode %+v, want %+v", got, r)
+	}
+}
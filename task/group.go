@@ -0,0 +1,36 @@
+package task
+
+//任务组的状态
+const (
+	GroupRunning = "running"
+	GroupSuccess = "success"
+	GroupFailure = "failure" //至少一个成员失败或被取消
+)
+
+//一组同时提交的任务，所有成员到达最终状态后提交Callback
+type Group struct {
+	Id        string       `json:"id"`
+	Members   []string     `json:"members"` //成员任务的uuid
+	Completed int64        `json:"completed,string"`
+	Failed    int64        `json:"failed,string"`
+	Callback  *TaskRequest `json:"callback"`
+}
+
+//已到达最终状态的成员个数
+func (g *Group) Done() int64 {
+	return g.Completed + g.Failed
+}
+
+func (g *Group) Pending() int64 {
+	return int64(len(g.Members)) - g.Done()
+}
+
+func (g *Group) State() string {
+	if g.Pending() > 0 {
+		return GroupRunning
+	}
+	if g.Failed != 0 {
+		return GroupFailure
+	}
+	return GroupSuccess
+}
@@ -0,0 +1,22 @@
+package task
+
+import (
+	"testing"
+)
+
+func TestGroupState(t *testing.T) {
+	g := &Group{Id: "g1", Members: []string{"a", "b", "c"}}
+	if g.State() != GroupRunning || g.Pending() != 3 {
+		t.Errorf("state=%s pending=%d", g.State(), g.Pending())
+	}
+	g.Completed = 2
+	g.Failed = 1
+	if g.State() != GroupFailure || g.Pending() != 0 || g.Done() != 3 {
+		t.Errorf("state=%s pending=%d done=%d", g.State(), g.Pending(), g.Done())
+	}
+	g.Completed = 3
+	g.Failed = 0
+	if g.State() != GroupSuccess {
+		t.Errorf("state=%s", g.State())
+	}
+}
@@ -0,0 +1,26 @@
+package task
+
+import (
+	"net/url"
+)
+
+//限流key的前缀
+const (
+	RateKeyBin    = "bin:"
+	RateKeyHost   = "host:"
+	RateKeyCustom = "key:"
+)
+
+//任务可能匹配的所有限流key：脚本任务的可执行文件名、RPC任务的主机和自定义key
+func (r *TaskRequest) RateLimitKeys() []string {
+	keys := make([]string, 0, 2)
+	if r.TaskType == ScriptTask {
+		keys = append(keys, RateKeyBin+r.BinName)
+	} else if u, err := url.Parse(r.BinName); err == nil && len(u.Host) != 0 {
+		keys = append(keys, RateKeyHost+u.Host)
+	}
+	if len(r.RateKey) != 0 {
+		keys = append(keys, RateKeyCustom+r.RateKey)
+	}
+	return keys
+}
@@ -0,0 +1,24 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRateLimitKeys(t *testing.T) {
+	cases := []struct {
+		r    TaskRequest
+		want []string
+	}{
+		{TaskRequest{BinName: "export", TaskType: ScriptTask}, []string{"bin:export"}},
+		{TaskRequest{BinName: "http://api.example.com:8080/v1/orders", TaskType: RpcTaskPOST},
+			[]string{"host:api.example.com:8080"}},
+		{TaskRequest{BinName: "export", TaskType: ScriptTask, RateKey: "db"}, []string{"bin:export", "key:db"}},
+		{TaskRequest{BinName: "%", TaskType: RpcTaskGET, RateKey: "db"}, []string{"key:db"}},
+	}
+	for _, c := range cases {
+		if got := c.r.RateLimitKeys(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: keys %v, want %v", c.r.BinName, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package task
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/the-no/kingtask/core/errors"
+)
+
+//重试间隔的增长方式
+const (
+	RetryFixed       = "fixed"       //每次间隔base_delay
+	RetryLinear      = "linear"      //第n次重试间隔n*base_delay
+	RetryExponential = "exponential" //第n次重试间隔base_delay*multiplier^(n-1)
+)
+
+const DefaultRetryMultiplier = 2
+
+//没有指定max_delay时的间隔上限，一年
+const MaxRetryDelay = 60 * 60 * 24 * 365
+
+//失败任务的重试策略，Strategy为空表示没有重试策略，此时使用time_interval
+type RetryPolicy struct {
+	Strategy    string  `json:"strategy"`
+	BaseDelay   int64   `json:"base_delay,string"`   //单位为秒
+	Multiplier  float64 `json:"multiplier,string"`   //exponential的倍数，为空表示2
+	MaxDelay    int64   `json:"max_delay,string"`    //间隔上限，单位为秒，为空表示一年
+	Jitter      float64 `json:"jitter,string"`       //0到1之间，间隔随机浮动的比例
+	MaxAttempts int     `json:"max_attempts,string"` //包括第一次执行的最多执行次数，为空表示不限次数
+}
+
+func (p *RetryPolicy) Enabled() bool {
+	return len(p.Strategy) != 0
+}
+
+func (p *RetryPolicy) Validate() error {
+	if !p.Enabled() {
+		return nil
+	}
+	switch p.Strategy {
+	case RetryFixed, RetryLinear, RetryExponential:
+	default:
+		return errors.ErrInvalidRetryPolicy
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < 0 || p.MaxAttempts < 0 {
+		return errors.ErrInvalidRetryPolicy
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return errors.ErrInvalidRetryPolicy
+	}
+	if p.Jitter < 0 || 1 < p.Jitter {
+		return errors.ErrInvalidRetryPolicy
+	}
+	return nil
+}
+
+//第retry次重试（从1开始）是否还在最多执行次数之内
+func (p *RetryPolicy) CanRetry(retry int) bool {
+	return p.MaxAttempts == 0 || retry < p.MaxAttempts
+}
+
+//第retry次重试（从1开始）前等待的秒数，random为[0,1)之间的随机数，用于计算jitter
+func (p *RetryPolicy) Delay(retry int, random float64) int64 {
+	if retry < 1 {
+		retry = 1
+	}
+	delay := float64(p.BaseDelay)
+	switch p.Strategy {
+	case RetryLinear:
+		delay *= float64(retry)
+	case RetryExponential:
+		multiplier := p.Multiplier
+		if multiplier == 0 {
+			multiplier = DefaultRetryMultiplier
+		}
+		delay *= math.Pow(multiplier, float64(retry-1))
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = MaxRetryDelay
+	}
+	if float64(maxDelay) < delay {
+		delay = float64(maxDelay)
+	}
+	//在[delay*(1-jitter), delay*(1+jitter))之间随机
+	delay += delay * p.Jitter * (2*random - 1)
+	if delay < 0 {
+		delay = 0
+	}
+	return int64(delay)
+}
+
+//检查retry_on规则，每个规则为失败分类或"分类:码"，码可以写成4xx、5xx的形式，
+//例如"timeout transport exit_code:75 http_status:5xx"
+func ValidateRetryOn(rules string) error {
+	for _, rule := range strings.Fields(rules) {
+		vec := strings.SplitN(rule, ":", 2)
+		switch vec[0] {
+		case errors.ClassTimeout, errors.ClassNotFound, errors.ClassTransport, errors.ClassUnknown:
+			if len(vec) == 2 {
+				return errors.ErrInvalidRetryOn
+			}
+		case errors.ClassExitCode, errors.ClassHttpStatus:
+			if len(vec) == 2 && !validCodePattern(vec[1]) {
+				return errors.ErrInvalidRetryOn
+			}
+		default:
+			return errors.ErrInvalidRetryOn
+		}
+	}
+	return nil
+}
+
+//失败是否可以重试，没有retry_on规则时所有失败都可以重试
+func (r *TaskRequest) Retryable(class string, code int) bool {
+	rules := strings.Fields(r.RetryOn)
+	if len(rules) == 0 {
+		return true
+	}
+	//旧版本worker的结果没有分类
+	if len(class) == 0 {
+		class = errors.ClassUnknown
+	}
+	for _, rule := range rules {
+		vec := strings.SplitN(rule, ":", 2)
+		if vec[0] != class {
+			continue
+		}
+		if len(vec) == 1 || matchCode(vec[1], code) {
+			return true
+		}
+	}
+	return false
+}
+
+func validCodePattern(pattern string) bool {
+	if len(pattern) == 0 {
+		return false
+	}
+	for _, c := range pattern {
+		if (c < '0' || '9' < c) && c != 'x' && c != 'X' {
+			return false
+		}
+	}
+	return true
+}
+
+//x匹配任意一位数字
+func matchCode(pattern string, code int) bool {
+	s := strconv.Itoa(code)
+	if len(s) != len(pattern) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != 'x' && pattern[i] != 'X' && pattern[i] != s[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package task
+
+import (
+	"testing"
+)
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		p     RetryPolicy
+		retry int
+		want  int64
+	}{
+		{RetryPolicy{Strategy: RetryFixed, BaseDelay: 30}, 1, 30},
+		{RetryPolicy{Strategy: RetryFixed, BaseDelay: 30}, 5, 30},
+		{RetryPolicy{Strategy: RetryLinear, BaseDelay: 30}, 3, 90},
+		{RetryPolicy{Strategy: RetryExponential, BaseDelay: 10}, 1, 10},
+		{RetryPolicy{Strategy: RetryExponential, BaseDelay: 10}, 4, 80},
+		{RetryPolicy{Strategy: RetryExponential, BaseDelay: 10, Multiplier: 3}, 3, 90},
+		{RetryPolicy{Strategy: RetryExponential, BaseDelay: 60, MaxDelay: 3600}, 10, 3600},
+		{RetryPolicy{Strategy: RetryExponential, BaseDelay: 60, MaxDelay: 3600}, 1000, 3600},
+		{RetryPolicy{Strategy: RetryExponential, BaseDelay: 60}, 1000, MaxRetryDelay},
+	}
+	for _, c := range cases {
+		if got := c.p.Delay(c.retry, 0.5); got != c.want {
+			t.Errorf("%+v retry %d delay=%d, want %d", c.p, c.retry, got, c.want)
+		}
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	p := RetryPolicy{Strategy: RetryFixed, BaseDelay: 100, Jitter: 0.2}
+	if got := p.Delay(1, 0); got != 80 {
+		t.Errorf("min delay=%d", got)
+	}
+	if got := p.Delay(1, 0.999); got < 119 || 120 < got {
+		t.Errorf("max delay=%d", got)
+	}
+	//jitter在上限之后计算
+	p = RetryPolicy{Strategy: RetryExponential, BaseDelay: 100, MaxDelay: 100, Jitter: 0.5}
+	if got := p.Delay(5, 0); got != 50 {
+		t.Errorf("capped delay=%d", got)
+	}
+}
+
+func TestRetryCanRetry(t *testing.T) {
+	p := RetryPolicy{Strategy: RetryFixed, MaxAttempts: 3}
+	if !p.CanRetry(1) || !p.CanRetry(2) || p.CanRetry(3) {
+		t.Errorf("max attempts 3 should allow 2 retries")
+	}
+	p.MaxAttempts = 0
+	if !p.CanRetry(100) {
+		t.Errorf("max attempts 0 should not limit retries")
+	}
+}
+
+func TestRetryValidate(t *testing.T) {
+	valid := []RetryPolicy{
+		{},
+		{Strategy: RetryFixed, BaseDelay: 10},
+		{Strategy: RetryExponential, BaseDelay: 10, Multiplier: 1.5, MaxDelay: 3600, Jitter: 1, MaxAttempts: 10},
+	}
+	for _, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%+v: %v", p, err)
+		}
+	}
+	invalid := []RetryPolicy{
+		{Strategy: "random"},
+		{Strategy: RetryFixed, BaseDelay: -1},
+		{Strategy: RetryExponential, Multiplier: 0.5},
+		{Strategy: RetryFixed, Jitter: 1.5},
+		{Strategy: RetryFixed, MaxAttempts: -1},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", p)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	r := &TaskRequest{RetryOn: "timeout transport exit_code:75 http_status:5xx http_status:429"}
+	cases := []struct {
+		class string
+		code  int
+		want  bool
+	}{
+		{"timeout", 0, true},
+		{"transport", 0, true},
+		{"not_found", 0, false},
+		{"exit_code", 75, true},
+		{"exit_code", 1, false},
+		{"http_status", 503, true},
+		{"http_status", 429, true},
+		{"http_status", 400, false},
+		{"unknown", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		if got := r.Retryable(c.class, c.code); got != c.want {
+			t.Errorf("retryable(%s, %d)=%v, want %v", c.class, c.code, got, c.want)
+		}
+	}
+
+	r.RetryOn = ""
+	if !r.Retryable("not_found", 0) {
+		t.Errorf("empty retry_on should retry every failure")
+	}
+	r.RetryOn = "exit_code"
+	if !r.Retryable("exit_code", 2) {
+		t.Errorf("exit_code without code should match every exit code")
+	}
+}
+
+func TestValidateRetryOn(t *testing.T) {
+	for _, rules := range []string{"", "timeout", "exit_code exit_code:1 http_status:5xx unknown"} {
+		if err := ValidateRetryOn(rules); err != nil {
+			t.Errorf("%q: %v", rules, err)
+		}
+	}
+	for _, rules := range []string{"oom", "timeout:1", "http_status:", "http_status:5y"} {
+		if err := ValidateRetryOn(rules); err == nil {
+			t.Errorf("%q should be invalid", rules)
+		}
+	}
+}
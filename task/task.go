@@ -8,25 +8,94 @@ const (
 	RpcTaskDELETE = 5
 )
 
+//任务优先级，worker总是先执行高优先级的任务
+const (
+	PriorityLow    = 1
+	PriorityNormal = 2
+	PriorityHigh   = 3
+)
+
+//从高到低排列的所有优先级
+var Priorities = []int{PriorityHigh, PriorityNormal, PriorityLow}
+
+//没有指定队列的任务放入默认队列
+const DefaultQueue = "default"
+
 type TaskRequest struct {
-	Uuid         string `json:"uuid"`
-	BinName      string `json:"bin_name"`
-	Args         string `json:"args"` //空格分隔各个参数
-	StartTime    int64  `json:"start_time,string"`
-	TimeInterval string `json:"time_interval"` //空格分隔各个参数
-	Index        int    `json:"index,string"`
-	MaxRunTime   int64  `json:"max_run_time,string"`
-	TaskType     int    `json:"task_type,string"`
+	Uuid         string      `json:"uuid"`
+	BinName      string      `json:"bin_name"`
+	Args         string      `json:"args"` //空格分隔各个参数
+	StartTime    int64       `json:"start_time,string"`
+	TimeInterval string      `json:"time_interval"` //空格分隔各个参数
+	Index        int         `json:"index,string"`
+	MaxRunTime   int64       `json:"max_run_time,string"`
+	TaskType     int         `json:"task_type,string"`
+	Priority     int         `json:"priority,string"`
+	Queue        string      `json:"queue"`
+	OrderKey     string      `json:"order_key"`     //相同order_key的任务按提交顺序逐个执行
+	UniqueKey    string      `json:"unique_key"`    //幂等提交的key，窗口期内重复提交返回同一个uuid
+	Timezone     string      `json:"timezone"`      //IANA时区，为空表示broker本地时区
+	Windows      string      `json:"windows"`       //允许执行的时间段，空格分隔，例如"01:00-05:00"
+	Calendars    string      `json:"calendars"`     //排除日历名，空格分隔
+	Retry        RetryPolicy `json:"retry"`         //指定时代替time_interval
+	RetryOn      string      `json:"retry_on"`      //可重试的失败分类，空格分隔，为空表示所有失败都重试
+	Workflow     string      `json:"workflow"`      //所属工作流的id
+	WorkflowNode string      `json:"workflow_node"` //在工作流中的节点名
+	Group        string      `json:"group"`         //所属任务组的id
+	RateKey      string      `json:"rate_key"`      //自定义的限流key
+	//相同concurrency_key的任务同时最多执行concurrency_limit个
+	ConcurrencyKey   string `json:"concurrency_key"`
+	ConcurrencyLimit int    `json:"concurrency_limit,string"`
+	//超过expires_at仍未执行的任务直接丢弃，ttl为从start_time开始的有效时长
+	ExpiresAt int64 `json:"expires_at,string"`
+	TTL       int64 `json:"ttl,string"`
+
+	OnSuccess *TaskRequest `json:"on_success"` //成功后提交的后续任务
+	OnFailure *TaskRequest `json:"on_failure"` //最终失败后提交的后续任务
+
+	//由后续任务机制创建时，父任务的uuid、状态和结果
+	ParentUuid   string `json:"parent_uuid"`
+	ParentState  string `json:"parent_state"`
+	ParentResult string `json:"parent_result"`
 }
 
+//任务到达最终状态后broker是否还需要处理，例如释放工作流的子节点、提交后续任务、更新任务组计数
+func (r *TaskRequest) HasFinishHook() bool {
+	return len(r.Workflow) != 0 || len(r.Group) != 0 || r.OnSuccess != nil || r.OnFailure != nil
+}
+
+//任务结果的状态
+const (
+	StateSuccess   = "success"
+	StateFailure   = "failure"
+	StateCancelled = "cancelled"
+	StateSkipped   = "skipped" //工作流中祖先节点失败，没有执行
+	StateExpired   = "expired" //超过expires_at，没有执行
+)
+
 type TaskResult struct {
 	TaskRequest
 	IsSuccess int64  `json:"is_success"`
 	Result    string `json:"result"`
+	State     string `json:"state"` //为空时由IsSuccess决定
+	//失败的分类，见errors.Classify
+	ErrorClass string `json:"error_class"`
+	ErrorCode  int    `json:"error_code,string"`
+}
+
+//周期任务，每次触发时以Request为模板创建一个新任务
+type Schedule struct {
+	Id       string      `json:"id"`
+	Cron     string      `json:"cron"` //5或6个字段的cron表达式
+	Request  TaskRequest `json:"request"`
+	NextTime int64       `json:"next_time,string"` //下一次触发时刻
 }
 
 type Reply struct {
 	IsResultExist int    `json:"is_result_exist"`
 	IsSuccess     int    `json:"is_success"`
 	Result        string `json:"message"`
+	State         string `json:"state"`
+	ErrorClass    string `json:"error_class"`
+	ErrorCode     int    `json:"error_code"`
 }
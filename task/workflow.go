@@ -0,0 +1,136 @@
+package task
+
+import (
+	"regexp"
+
+	"github.com/the-no/kingtask/core/errors"
+)
+
+//工作流中节点的状态
+const (
+	NodePending   = "pending" //等待父节点完成
+	NodeRunning   = "running" //已提交执行
+	NodeSuccess   = "success"
+	NodeFailure   = "failure"
+	NodeCancelled = "cancelled"
+	NodeSkipped   = "skipped" //祖先节点失败，不再执行
+)
+
+//工作流整体的状态
+const (
+	WorkflowRunning = "running"
+	WorkflowSuccess = "success"
+	WorkflowFailure = "failure"
+)
+
+var nodeNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type WorkflowNode struct {
+	Name      string   `json:"name"`
+	Uuid      string   `json:"uuid"`
+	DependsOn []string `json:"depends_on"`
+	State     string   `json:"state"`
+}
+
+//由depends_on组成的有向无环图，节点的所有父节点成功后才执行
+type Workflow struct {
+	Id    string         `json:"id"`
+	Nodes []WorkflowNode `json:"nodes"`
+}
+
+func (w *Workflow) Node(name string) *WorkflowNode {
+	for i := range w.Nodes {
+		if w.Nodes[i].Name == name {
+			return &w.Nodes[i]
+		}
+	}
+	return nil
+}
+
+//直接依赖name的节点
+func (w *Workflow) Children(name string) []*WorkflowNode {
+	children := make([]*WorkflowNode, 0)
+	for i := range w.Nodes {
+		for _, parent := range w.Nodes[i].DependsOn {
+			if parent == name {
+				children = append(children, &w.Nodes[i])
+				break
+			}
+		}
+	}
+	return children
+}
+
+//检查节点名唯一、依赖的节点存在且没有环
+func (w *Workflow) Validate() error {
+	if len(w.Nodes) == 0 {
+		return errors.ErrInvalidWorkflow
+	}
+	indegree := make(map[string]int, len(w.Nodes))
+	for _, node := range w.Nodes {
+		if !nodeNameRegexp.MatchString(node.Name) {
+			return errors.ErrInvalidWorkflow
+		}
+		if _, ok := indegree[node.Name]; ok {
+			return errors.ErrInvalidWorkflow
+		}
+		indegree[node.Name] = len(node.DependsOn)
+	}
+	for _, node := range w.Nodes {
+		seen := make(map[string]bool, len(node.DependsOn))
+		for _, parent := range node.DependsOn {
+			if _, ok := indegree[parent]; !ok || seen[parent] {
+				return errors.ErrInvalidWorkflow
+			}
+			seen[parent] = true
+		}
+	}
+
+	//拓扑排序，能访问到所有节点说明没有环
+	queue := make([]string, 0, len(w.Nodes))
+	for _, node := range w.Nodes {
+		if indegree[node.Name] == 0 {
+			queue = append(queue, node.Name)
+		}
+	}
+	visited := 0
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, child := range w.Children(name) {
+			indegree[child.Name]--
+			if indegree[child.Name] == 0 {
+				queue = append(queue, child.Name)
+			}
+		}
+	}
+	if visited != len(w.Nodes) {
+		return errors.ErrInvalidWorkflow
+	}
+	return nil
+}
+
+//所有节点都结束前为running，全部成功为success，否则为failure
+func (w *Workflow) State() string {
+	state := WorkflowSuccess
+	for _, node := range w.Nodes {
+		switch node.State {
+		case NodePending, NodeRunning:
+			return WorkflowRunning
+		case NodeSuccess:
+		default:
+			state = WorkflowFailure
+		}
+	}
+	return state
+}
+
+//各状态的节点个数
+func (w *Workflow) Summary() map[string]int {
+	summary := make(map[string]int)
+	for _, node := range w.Nodes {
+		summary[node.State]++
+	}
+	return summary
+}
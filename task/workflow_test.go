@@ -0,0 +1,63 @@
+package task
+
+import (
+	"testing"
+)
+
+func newWorkflow(deps map[string][]string, names ...string) *Workflow {
+	w := &Workflow{Id: "w1"}
+	for _, name := range names {
+		w.Nodes = append(w.Nodes, WorkflowNode{Name: name, DependsOn: deps[name], State: NodePending})
+	}
+	return w
+}
+
+func TestWorkflowValidate(t *testing.T) {
+	w := newWorkflow(map[string][]string{
+		"transform": {"extract"},
+		"load":      {"transform"},
+		"report":    {"load", "extract"},
+	}, "extract", "transform", "load", "report")
+	if err := w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	children := w.Children("extract")
+	if len(children) != 2 || children[0].Name != "transform" || children[1].Name != "report" {
+		t.Errorf("children %v", children)
+	}
+
+	invalid := []*Workflow{
+		newWorkflow(nil),
+		newWorkflow(nil, "a", "a"),
+		newWorkflow(nil, "a b"),
+		newWorkflow(map[string][]string{"a": {"c"}}, "a", "b"),
+		newWorkflow(map[string][]string{"b": {"a", "a"}}, "a", "b"),
+		newWorkflow(map[string][]string{"a": {"a"}}, "a"),
+		newWorkflow(map[string][]string{"a": {"c"}, "b": {"a"}, "c": {"b"}}, "a", "b", "c"),
+	}
+	for i, w := range invalid {
+		if err := w.Validate(); err == nil {
+			t.Errorf("workflow %d should be invalid", i)
+		}
+	}
+}
+
+func TestWorkflowState(t *testing.T) {
+	w := newWorkflow(map[string][]string{"b": {"a"}}, "a", "b")
+	if state := w.State(); state != WorkflowRunning {
+		t.Errorf("state=%s", state)
+	}
+	w.Node("a").State = NodeSuccess
+	w.Node("b").State = NodeSuccess
+	if state := w.State(); state != WorkflowSuccess {
+		t.Errorf("state=%s", state)
+	}
+	w.Node("a").State = NodeFailure
+	w.Node("b").State = NodeSkipped
+	if state := w.State(); state != WorkflowFailure {
+		t.Errorf("state=%s", state)
+	}
+	if summary := w.Summary(); summary[NodeFailure] != 1 || summary[NodeSkipped] != 1 {
+		t.Errorf("summary %v", summary)
+	}
+}
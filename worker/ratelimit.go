@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flike/golog"
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/store"
+	"github.com/the-no/kingtask/task"
+)
+
+func checkRateLimits(limits []config.RateLimit) error {
+	for _, limit := range limits {
+		if len(limit.Key) == 0 || limit.Limit <= 0 || limit.Period <= 0 {
+			return errors.ErrInvalidRateLimit
+		}
+	}
+	return nil
+}
+
+//按固定窗口计数，所有worker共用同一个计数器，只有所有规则都允许执行时才计数。
+//任务超过任一规则的限制时返回下一个窗口的开始时刻，否则返回0
+func (w *Worker) rateLimited(req *task.TaskRequest, now int64) int64 {
+	if len(w.cfg.RateLimits) == 0 {
+		return 0
+	}
+	counters := make([]store.RateCounter, 0)
+	//counters[i]所在窗口的结束时刻
+	ends := make([]int64, 0)
+	for _, key := range req.RateLimitKeys() {
+		for _, limit := range w.cfg.RateLimits {
+			if limit.Key != key {
+				continue
+			}
+			window := now / limit.Period
+			counters = append(counters, store.RateCounter{
+				Key:    fmt.Sprintf(config.RateLimitKey, key, window),
+				Limit:  limit.Limit,
+				Expire: time.Second * time.Duration(limit.Period),
+			})
+			ends = append(ends, (window+1)*limit.Period)
+		}
+	}
+	if len(counters) == 0 {
+		return 0
+	}
+	full, err := w.store.TakeRate(counters)
+	//计数失败时不限流，避免任务无法执行
+	if err != nil {
+		golog.Error("Worker", "rateLimited", err.Error(), 0, "uuid", req.Uuid)
+		return 0
+	}
+	var until int64
+	for _, i := range full {
+		if until < ends[i] {
+			until = ends[i]
+		}
+	}
+	return until
+}
+
+//占用任务concurrency_key的一个位置，位置的过期时刻和租约相同，worker崩溃后位置随租约过期释放。
+//位置已满时任务进入等待列表，其他任务释放位置后再放回待执行队列
+func (w *Worker) acquireSlot(req *task.TaskRequest, now int64) bool {
+	if len(req.ConcurrencyKey) == 0 {
+		return true
+	}
+	deadline := now + w.runTime(req) + w.cfg.LeaseTime
+	ok, err := w.store.AcquireSlot(w.id, req.ConcurrencyKey, req.Uuid, req.ConcurrencyLimit, now, deadline)
+	//占用失败时不限制，避免任务无法执行
+	if err != nil {
+		golog.Error("Worker", "acquireSlot", err.Error(), 0,
+			"concurrency_key", req.ConcurrencyKey, "uuid", req.Uuid)
+		return true
+	}
+	return ok
+}
+
+//释放位置并交给等待中的下一个任务，为它保留的位置按默认执行时间计算过期时刻
+func (w *Worker) releaseSlot(req *task.TaskRequest) {
+	if len(req.ConcurrencyKey) == 0 {
+		return
+	}
+	now := w.clock.Now().Unix()
+	deadline := now + w.cfg.TaskRunTime + w.cfg.LeaseTime
+	err := w.store.ReleaseSlot(req.ConcurrencyKey, req.Uuid, req.ConcurrencyLimit, now, deadline)
+	if err != nil {
+		golog.Error("Worker", "releaseSlot", err.Error(), 0,
+			"concurrency_key", req.ConcurrencyKey, "uuid", req.Uuid)
+	}
+}
@@ -5,113 +5,183 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/flike/golog"
 
 	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/core/calendar"
+	"github.com/the-no/kingtask/core/clock"
 	"github.com/the-no/kingtask/core/errors"
+	"github.com/the-no/kingtask/store"
 	"github.com/the-no/kingtask/task"
-	redis "gopkg.in/redis.v3"
 )
 
 type Worker struct {
-	cfg         *config.WorkerConfig
-	redisAddr   string
-	redisDB     int
-	running     bool
-	redisClient *redis.Client
+	cfg          *config.WorkerConfig
+	id           string
+	running      bool
+	store        store.Store
+	dequeueCount int64
+	//排除日历名 -> 日历
+	calendars map[string]*calendar.Calendar
+	//调度使用的时钟，测试中可替换为clock.Manual
+	clock clock.Clock
 }
 
 func NewWorker(cfg *config.WorkerConfig) (*Worker, error) {
-	var err error
+	s, err := store.NewRedisStore(cfg.RedisAddr)
+	if err != nil {
+		golog.Error("worker", "NewWorker", "new redis store fail", 0, "err", err.Error())
+		return nil, err
+	}
+	return NewWorkerWithStore(cfg, s)
+}
+
+//使用指定的存储创建worker，例如和broker共用的store.NewMemoryStore()
+func NewWorkerWithStore(cfg *config.WorkerConfig, s store.Store) (*Worker, error) {
 	w := new(Worker)
 	w.cfg = cfg
-
-	vec := strings.SplitN(cfg.RedisAddr, "/", 2)
-	if len(vec) == 2 {
-		w.redisAddr = vec[0]
-		w.redisDB, err = strconv.Atoi(vec[1])
+	w.id = cfg.WorkerId
+	if len(w.id) == 0 {
+		hostname, err := os.Hostname()
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		w.redisAddr = vec[0]
-		w.redisDB = config.DefaultRedisDB
+		w.id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
 	}
-
-	w.redisClient = redis.NewClient(
-		&redis.Options{
-			Addr:     w.redisAddr,
-			Password: "", // no password set
-			DB:       int64(w.redisDB),
-		},
-	)
-	_, err = w.redisClient.Ping().Result()
+	if w.cfg.LeaseTime == 0 {
+		w.cfg.LeaseTime = config.DefaultLeaseTime
+	}
+	if len(w.cfg.Queues) == 0 {
+		w.cfg.Queues = []string{task.DefaultQueue}
+	}
+	err := checkRateLimits(w.cfg.RateLimits)
 	if err != nil {
-		golog.Error("worker", "NewWorker", "ping redis fail", 0, "err", err.Error())
 		return nil, err
 	}
+	w.calendars = make(map[string]*calendar.Calendar)
+	if len(cfg.CalendarPath) != 0 {
+		w.calendars, err = calendar.LoadDir(cfg.CalendarPath)
+		if err != nil {
+			golog.Error("worker", "NewWorkerWithStore", "load calendars fail", 0,
+				"calendar_path", cfg.CalendarPath, "err", err.Error())
+			return nil, err
+		}
+	}
+	w.store = s
+	w.clock = clock.Real
 
 	return w, nil
 }
 
+//替换判断有效期、限流和租约使用的时钟，需在Run之前设置
+func (w *Worker) SetClock(c clock.Clock) {
+	w.clock = c
+}
+
 func (w *Worker) Run() error {
 	var taskResult *task.TaskResult
 	w.running = true
 	for w.running {
-		uuid, err := w.redisClient.SPop(config.RequestUuidSet).Result()
+		deadline := w.clock.Now().Unix() + w.cfg.TaskRunTime + w.cfg.LeaseTime
+		uuid, err := w.store.Dequeue(w.id, w.readyKeys(), deadline)
 		//没有请求
-		if err == redis.Nil {
-			time.Sleep(time.Second)
+		if err == errors.ErrQueueEmpty {
+			w.clock.Sleep(time.Second)
 			continue
 		}
 		if err != nil {
-			golog.Error("Worker", "run", "spop error", 0, "error", err.Error())
+			golog.Error("Worker", "run", "dequeue error", 0, "error", err.Error())
+			w.clock.Sleep(time.Second)
 			continue
 		}
 		reqKey := fmt.Sprintf("t_%s", uuid)
 
 		//获取请求中所有值
-		request, err := w.redisClient.HMGet(reqKey,
-			"uuid",
-			"bin_name",
-			"args",
-			"start_time",
-			"time_interval",
-			"index",
-			"max_run_time",
-			"task_type",
-		).Result()
+		request, err := w.store.GetRequest(uuid)
+		//key不存在
+		if err == errors.ErrRequestNotExist {
+			golog.Error("Worker", "run", "Key is not exist", 0, "req_key", reqKey)
+			w.ack(uuid)
+			continue
+		}
 		if err != nil {
 			golog.Error("Worker", "run", err.Error(), 0, "req_key", reqKey)
 			continue
 		}
-		//key不存在
-		if request[0] == nil {
-			golog.Error("Worker", "run", "Key is not exist", 0, "req_key", reqKey)
+		//任务在执行前已被取消
+		if w.isCancelled(uuid) {
+			golog.Info("Worker", "run", "task cancelled", 0, "req_key", reqKey)
+			w.SetTaskResult(&task.TaskResult{
+				TaskRequest: *request,
+				IsSuccess:   int64(0),
+				Result:      errors.ErrTaskCancelled.Error(),
+				State:       task.StateCancelled,
+			})
+			w.releaseOrderKey(request)
+			w.releaseSlot(request)
+			w.ack(uuid)
 			continue
 		}
-		_, err = w.redisClient.Del(reqKey).Result()
-		if err != nil {
-			golog.Error("Worker", "run", "delete result failed", 0, "req_key", reqKey)
+		now := w.clock.Now().Unix()
+		//超过有效期的任务不再执行
+		if request.ExpiresAt != 0 && request.ExpiresAt <= now {
+			golog.Info("Worker", "run", "task expired", 0,
+				"req_key", reqKey, "expires_at", request.ExpiresAt)
+			w.SetTaskResult(&task.TaskResult{
+				TaskRequest: *request,
+				IsSuccess:   int64(0),
+				Result:      errors.ErrTaskExpired.Error(),
+				State:       task.StateExpired,
+			})
+			w.SetExpiredTaskCount(reqKey)
+			w.releaseOrderKey(request)
+			w.releaseSlot(request)
+			w.ack(uuid)
+			continue
+		}
+		//延时、重试、租约过期和order_key释放后进入待执行队列的任务都可能不在允许执行的时间内
+		//从等待列表唤醒的任务已保留了位置，推迟时要释放，交给下一个等待的任务
+		if next := w.nextAllowedTime(request, now); next != 0 {
+			w.releaseSlot(request)
+			w.deferTask(uuid, next, "outside execution window")
+			continue
 		}
+		//超过限流的任务推迟到下一个周期，不算作失败
+		if until := w.rateLimited(request, now); until != 0 {
+			w.releaseSlot(request)
+			w.deferTask(uuid, until, "rate limited")
+			continue
+		}
+		//concurrency_key的位置已满，任务已进入等待列表，有位置释放时再放回待执行队列
+		if !w.acquireSlot(request, now) {
+			golog.Info("Worker", "run", "concurrency limited, waiting", 0,
+				"req_key", reqKey, "concurrency_key", request.ConcurrencyKey)
+			continue
+		}
+		w.extendLease(request)
 
 		taskResult, err = w.DoTaskRequest(request)
 		if err != nil {
 			golog.Error("Worker", "run", "DoTaskRequest", 0, "err", err.Error(),
-				"req_key", reqKey, "bin_name", request[1], "task_type", request[7])
+				"req_key", reqKey, "bin_name", request.BinName, "task_type", request.TaskType)
 		} else {
 			w.SetSuccessTaskCount(reqKey)
 		}
 
 		if taskResult != nil {
+			//执行中被取消的任务失败后不再重试
+			if taskResult.IsSuccess == int64(0) && w.isCancelled(uuid) {
+				taskResult.State = task.StateCancelled
+			}
 			err = w.SetTaskResult(taskResult)
 			if err != nil {
 				golog.Error("Worker", "run", "DoScrpitTaskRequest", 0,
@@ -119,18 +189,135 @@ func (w *Worker) Run() error {
 			}
 			golog.Info("worker", "run", "do task success", 0, "req_key", reqKey,
 				"result", taskResult.Result)
+			//失败的任务由broker决定是否重试，成功和取消的任务在这里释放order_key
+			if taskResult.IsSuccess == int64(1) || taskResult.State == task.StateCancelled {
+				w.releaseOrderKey(request)
+			}
 		}
+		w.releaseSlot(request)
+		w.ack(uuid)
 
 		if w.cfg.Peroid != 0 {
-			time.Sleep(time.Second * time.Duration(w.cfg.Peroid))
+			w.clock.Sleep(time.Second * time.Duration(w.cfg.Peroid))
 		}
 	}
 	return nil
 }
 
+//只取本worker订阅的队列，按优先级从高到低排列，
+//配置了starve_interval时每隔starve_interval次反向排列一次，避免低优先级任务饿死
+func (w *Worker) readyKeys() []string {
+	w.dequeueCount++
+	reverse := w.cfg.StarveInterval > 0 && w.dequeueCount%w.cfg.StarveInterval == 0
+	keys := make([]string, 0, len(task.Priorities)*len(w.cfg.Queues))
+	for i := range task.Priorities {
+		priority := task.Priorities[i]
+		if reverse {
+			priority = task.Priorities[len(task.Priorities)-1-i]
+		}
+		for _, queue := range w.cfg.Queues {
+			keys = append(keys, store.ReadyKey(queue, priority))
+		}
+	}
+	return keys
+}
+
+//任务的最长运行时间，不小于task_run_time
+func (w *Worker) runTime(req *task.TaskRequest) int64 {
+	if req.MaxRunTime > w.cfg.TaskRunTime {
+		return req.MaxRunTime
+	}
+	return w.cfg.TaskRunTime
+}
+
+//任务不在允许执行的时间内时返回下一个允许执行的时刻，否则返回0
+func (w *Worker) nextAllowedTime(req *task.TaskRequest, now int64) int64 {
+	r, err := calendar.NewRule(req.Timezone, req.Windows, req.Calendars, w.calendars)
+	//规则已由broker检查，这里出错说明worker的配置不同，不限制，避免任务无法执行
+	if err != nil {
+		golog.Error("Worker", "nextAllowedTime", err.Error(), 0,
+			"uuid", req.Uuid, "calendars", req.Calendars)
+		return 0
+	}
+	if r == nil {
+		return 0
+	}
+	next := r.Next(time.Unix(now, 0))
+	if next.IsZero() {
+		golog.Error("Worker", "nextAllowedTime", errors.ErrInvalidWindow.Error(), 0,
+			"uuid", req.Uuid, "windows", req.Windows, "calendars", req.Calendars)
+		return 0
+	}
+	if next.Unix() <= now {
+		return 0
+	}
+	return next.Unix()
+}
+
+//释放租约，任务到startTime时刻重新进入待执行队列
+func (w *Worker) deferTask(uuid string, startTime int64, reason string) {
+	reqKey := fmt.Sprintf("t_%s", uuid)
+	held, err := w.store.Defer(w.id, uuid, startTime)
+	if err != nil {
+		golog.Error("Worker", "deferTask", err.Error(), 0, "req_key", reqKey)
+		return
+	}
+	if held {
+		golog.Info("Worker", "deferTask", reason, 0,
+			"req_key", reqKey, "start_time", startTime)
+	}
+}
+
+//按任务自身的最长运行时间延长租约
+func (w *Worker) extendLease(req *task.TaskRequest) {
+	if req.MaxRunTime <= w.cfg.TaskRunTime {
+		return
+	}
+	deadline := w.clock.Now().Unix() + req.MaxRunTime + w.cfg.LeaseTime
+	err := w.store.ExtendLease(w.id, req.Uuid, deadline)
+	if err != nil {
+		golog.Error("Worker", "extendLease", err.Error(), 0, "uuid", req.Uuid)
+	}
+}
+
+func (w *Worker) isCancelled(uuid string) bool {
+	cancelled, err := w.store.IsCancelled(uuid)
+	if err != nil {
+		golog.Error("Worker", "isCancelled", err.Error(), 0, "uuid", uuid)
+		return false
+	}
+	return cancelled
+}
+
+func (w *Worker) releaseOrderKey(req *task.TaskRequest) {
+	if len(req.OrderKey) == 0 {
+		return
+	}
+	_, err := w.store.ReleaseOrderKey(req.OrderKey, req.Uuid)
+	if err != nil {
+		golog.Error("Worker", "releaseOrderKey", err.Error(), 0,
+			"order_key", req.OrderKey, "uuid", req.Uuid)
+	}
+}
+
+//确认任务已处理完成，释放租约并删除请求
+func (w *Worker) ack(uuid string) {
+	reqKey := fmt.Sprintf("t_%s", uuid)
+	held, err := w.store.Ack(w.id, uuid)
+	if err != nil {
+		golog.Error("Worker", "ack", "ack failed", 0,
+			"req_key", reqKey, "err", err.Error())
+		return
+	}
+	//租约已过期，任务可能已被重新投递
+	if !held {
+		golog.Warn("Worker", "ack", "lease expired", 0, "req_key", reqKey)
+	}
+}
+
 func (w *Worker) Close() {
 	w.running = false
-	w.redisClient.Close()
+	w.store.Close()
 }
 
 func (w *Worker) DoRpcTaskRequest(req *task.TaskRequest) (string, error) {
@@ -153,6 +340,12 @@ func (w *Worker) DoRpcTaskRequest(req *task.TaskRequest) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	//后续任务通过头部获得父任务的信息，结果可能包含换行，需要转义
+	if len(req.ParentUuid) != 0 {
+		request.Header.Set("X-Kingtask-Parent-Uuid", req.ParentUuid)
+		request.Header.Set("X-Kingtask-Parent-State", req.ParentState)
+		request.Header.Set("X-Kingtask-Parent-Result", neturl.QueryEscape(req.ParentResult))
+	}
 	result, err := w.callRpc(request, time.Second*time.Duration(req.MaxRunTime))
 	return result, err
 }
@@ -185,7 +378,10 @@ func (w *Worker) callRpc(req *http.Request, maxRunTime time.Duration) (string, e
 
 	r, err := client.Do(req)
 	if err != nil {
-		return "", err
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return "", errors.NewTaskError(errors.ClassTimeout, 0, err.Error())
+		}
+		return "", errors.NewTaskError(errors.ClassTransport, 0, err.Error())
 	}
 	defer r.Body.Close()
 	buf, err := ioutil.ReadAll(r.Body)
@@ -193,39 +389,18 @@ func (w *Worker) callRpc(req *http.Request, maxRunTime time.Duration) (string, e
 		return "", err
 	}
 	if r.StatusCode != http.StatusOK {
-		return "", errors.NewError(string(buf))
+		return "", errors.NewTaskError(errors.ClassHttpStatus, r.StatusCode, string(buf))
 	}
 
 	return string(buf), nil
 }
 
-func (w *Worker) DoTaskRequest(args []interface{}) (*task.TaskResult, error) {
+func (w *Worker) DoTaskRequest(req *task.TaskRequest) (*task.TaskResult, error) {
 	var err error
 	var output string
 
-	req := new(task.TaskRequest)
 	ret := new(task.TaskResult)
 
-	req.Uuid = args[0].(string)
-	req.BinName = args[1].(string)
-	req.Args = args[2].(string)
-	req.StartTime, err = strconv.ParseInt(args[3].(string), 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	req.TimeInterval = args[4].(string)
-	req.Index, err = strconv.Atoi(args[5].(string))
-	if err != nil {
-		return nil, err
-	}
-	req.MaxRunTime, err = strconv.ParseInt(args[6].(string), 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	req.TaskType, err = strconv.Atoi(args[7].(string))
-	if err != nil {
-		return nil, err
-	}
 	switch req.TaskType {
 	case task.ScriptTask:
 		output, err = w.DoScriptTaskRequest(req)
@@ -240,6 +415,7 @@ func (w *Worker) DoTaskRequest(args []interface{}) (*task.TaskResult, error) {
 	if err != nil {
 		ret.IsSuccess = int64(0)
 		ret.Result = err.Error()
+		ret.ErrorClass, ret.ErrorCode = errors.Classify(err)
 		return ret, nil
 	}
 	ret.IsSuccess = int64(1)
@@ -267,16 +443,30 @@ func (w *Worker) DoScriptTaskRequest(req *task.TaskRequest) (string, error) {
 	} else {
 		maxRunTime = req.MaxRunTime
 	}
+	//后续任务通过环境变量获得父任务的信息
+	var env []string
+	if len(req.ParentUuid) != 0 {
+		env = append(os.Environ(),
+			"KINGTASK_PARENT_UUID="+req.ParentUuid,
+			"KINGTASK_PARENT_STATE="+req.ParentState,
+			"KINGTASK_PARENT_RESULT="+req.ParentResult,
+		)
+	}
 	if len(req.Args) == 0 {
-		output, err = w.ExecBin(binPath, nil, maxRunTime)
+		output, err = w.ExecBinWithEnv(binPath, nil, env, maxRunTime)
 	} else {
 		argsVec := strings.Split(req.Args, " ")
-		output, err = w.ExecBin(binPath, argsVec, maxRunTime)
+		output, err = w.ExecBinWithEnv(binPath, argsVec, env, maxRunTime)
 	}
 	return output, err
 }
 
 func (w *Worker) ExecBin(binPath string, args []string, maxRunTime int64) (string, error) {
+	return w.ExecBinWithEnv(binPath, args, nil, maxRunTime)
+}
+
+//env为空时继承worker的环境变量
+func (w *Worker) ExecBinWithEnv(binPath string, args []string, env []string, maxRunTime int64) (string, error) {
 	var cmd *exec.Cmd
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -288,6 +478,7 @@ func (w *Worker) ExecBin(binPath string, args []string, maxRunTime int64) (strin
 		cmd = exec.Command(binPath, args...)
 	}
 
+	cmd.Env = env
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	cmd.Start() // attention!
@@ -295,6 +486,10 @@ func (w *Worker) ExecBin(binPath string, args []string, maxRunTime int64) (strin
 	err, _ = w.CmdRunWithTimeout(cmd,
 		time.Duration(maxRunTime)*time.Second,
 	)
+	//非0退出码
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", errors.NewTaskError(errors.ClassExitCode, exitErr.ExitCode(), err.Error())
+	}
 	if err != nil {
 		return "", err
 	}
@@ -336,56 +531,50 @@ func (w *Worker) CmdRunWithTimeout(cmd *exec.Cmd, timeout time.Duration) (error,
 }
 
 func (w *Worker) SetTaskResult(result *task.TaskResult) error {
-	key := fmt.Sprintf("r_%s", result.Uuid)
-	setCmd := w.redisClient.HMSet(key,
-		"uuid", result.Uuid,
-		"bin_name", result.BinName,
-		"args", result.Args,
-		"start_time", strconv.FormatInt(result.StartTime, 10),
-		"time_interval", result.TimeInterval,
-		"index", strconv.Itoa(result.Index),
-		"max_run_time", strconv.FormatInt(result.MaxRunTime, 10),
-		"task_type", strconv.Itoa(result.TaskType),
-		"is_success", strconv.Itoa(int(result.IsSuccess)),
-		"result", result.Result,
-	)
-	err := setCmd.Err()
+	err := w.store.SaveResult(result, time.Second*time.Duration(w.cfg.ResultKeepTime))
 	if err != nil {
 		return err
 	}
-	if result.IsSuccess == int64(0) {
-		saddCmd := w.redisClient.SAdd(config.FailResultUuidSet, result.Uuid)
-		err = saddCmd.Err()
+	//取消和过期的任务不再重试
+	if result.IsSuccess == int64(0) && result.State != task.StateCancelled && result.State != task.StateExpired {
+		err = w.store.AddFailed(result.Uuid)
+		if err != nil {
+			return err
+		}
+	} else if result.HasFinishHook() {
+		//失败的任务由broker判断是否为最终失败
+		err = w.store.AddFinished(result.Uuid)
 		if err != nil {
 			return err
 		}
-	}
-	_, err = w.redisClient.Expire(key, time.Second*time.Duration(w.cfg.ResultKeepTime)).Result()
-	if err != nil {
-		return err
 	}
 	return nil
 }
 
 func (w *Worker) SetSuccessTaskCount(reqKey string) error {
 	successTaskKey := fmt.Sprintf(config.SuccessTaskKey,
-		time.Now().Format(config.TimeFormat))
-	count, err := w.redisClient.Incr(successTaskKey).Result()
+		w.clock.Now().Format(config.TimeFormat))
+	//保存一个月
+	expireTime := time.Second * time.Duration(60*60*24*30)
+	_, err := w.store.IncrCounter(successTaskKey, expireTime)
 	if err != nil {
 		golog.Error("Worker", "SetSuccessTaskCount", "Incr", 0, "err", err.Error(),
 			"req_key", reqKey)
 		return err
 	}
-	//第一次设置该key
-	if count == 1 {
-		//保存一个月
-		expireTime := time.Second * time.Duration(60*60*24*30)
-		_, err = w.redisClient.Expire(successTaskKey, expireTime).Result()
-		if err != nil {
-			golog.Error("Worker", "SetSuccessTaskCount", "Expire", 0, "err", err.Error(),
-				"req_key", reqKey)
-			return err
-		}
+	return nil
+}
+
+func (w *Worker) SetExpiredTaskCount(reqKey string) error {
+	expiredTaskKey := fmt.Sprintf(config.ExpiredTaskKey,
+		w.clock.Now().Format(config.TimeFormat))
+	//保存一个月
+	expireTime := time.Second * time.Duration(60*60*24*30)
+	_, err := w.store.IncrCounter(expiredTaskKey, expireTime)
+	if err != nil {
+		golog.Error("Worker", "SetExpiredTaskCount", "Incr", 0, "err", err.Error(),
+			"req_key", reqKey)
+		return err
 	}
 	return nil
 }
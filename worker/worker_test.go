@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/the-no/kingtask/config"
+	"github.com/the-no/kingtask/store"
+	"github.com/the-no/kingtask/task"
+)
+
+func newTestWorker(t *testing.T, s store.Store) *Worker {
+	cfg := &config.WorkerConfig{WorkerId: "test", TaskRunTime: 30}
+	w, err := NewWorkerWithStore(cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestNextAllowedTime(t *testing.T) {
+	w := newTestWorker(t, store.NewMemoryStore())
+	req := &task.TaskRequest{
+		Uuid:     "window",
+		Timezone: "UTC",
+		Windows:  "01:00-05:00",
+	}
+	inside := time.Date(2026, 1, 1, 2, 0, 0, 0, time.UTC).Unix()
+	if next := w.nextAllowedTime(req, inside); next != 0 {
+		t.Errorf("next=%d inside the window", next)
+	}
+	//租约过期或被推迟后在窗口外进入待执行队列，推迟到下一个窗口
+	outside := time.Date(2026, 1, 1, 6, 0, 0, 0, time.UTC).Unix()
+	want := time.Date(2026, 1, 2, 1, 0, 0, 0, time.UTC).Unix()
+	if next := w.nextAllowedTime(req, outside); next != want {
+		t.Errorf("next=%d, want %d", next, want)
+	}
+	if next := w.nextAllowedTime(&task.TaskRequest{Uuid: "any"}, outside); next != 0 {
+		t.Errorf("next=%d without rule", next)
+	}
+}
+
+func TestRateLimitedChargesOnAdmit(t *testing.T) {
+	s := store.NewMemoryStore()
+	w := newTestWorker(t, s)
+	w.cfg.RateLimits = []config.RateLimit{
+		{Key: "bin:echo", Limit: 10, Period: 60},
+		{Key: "key:report", Limit: 1, Period: 60},
+	}
+	req := &task.TaskRequest{Uuid: "a", BinName: "echo", TaskType: task.ScriptTask, RateKey: "report"}
+	now := int64(120)
+	if until := w.rateLimited(req, now); until != 0 {
+		t.Fatalf("until=%d", until)
+	}
+	//key:report已满，被拒绝的任务不占用bin:echo的配额
+	for i := 0; i < 3; i++ {
+		if until := w.rateLimited(req, now); until != 180 {
+			t.Fatalf("until=%d", until)
+		}
+	}
+	if count, _ := s.GetCounter(fmt.Sprintf(config.RateLimitKey, "bin:echo", now/60)); count != 1 {
+		t.Errorf("bin:echo count=%d", count)
+	}
+	if count, _ := s.GetCounter(fmt.Sprintf(config.RateLimitKey, "key:report", now/60)); count != 1 {
+		t.Errorf("key:report count=%d", count)
+	}
+}
+
+func TestConcurrencySlotHandover(t *testing.T) {
+	s := store.NewMemoryStore()
+	w := newTestWorker(t, s)
+	keys := w.readyKeys()
+	now := w.clock.Now().Unix()
+	reqs := make([]*task.TaskRequest, 0)
+	for _, uuid := range []string{"a", "b"} {
+		req := &task.TaskRequest{Uuid: uuid, BinName: "echo", ConcurrencyKey: "db", ConcurrencyLimit: 1}
+		s.Enqueue(req)
+		s.Dequeue(w.id, keys, now+100)
+		reqs = append(reqs, req)
+	}
+	if !w.acquireSlot(reqs[0], now) {
+		t.Fatalf("acquire a should succeed")
+	}
+	//b进入等待列表，不再轮询待执行队列
+	if w.acquireSlot(reqs[1], now) {
+		t.Fatalf("acquire b should wait")
+	}
+	if uuid, err := s.Dequeue(w.id, keys, now+100); err == nil {
+		t.Fatalf("waiting task dequeued uuid=%s", uuid)
+	}
+	w.releaseSlot(reqs[0])
+	if uuid, _ := s.Dequeue(w.id, keys, now+100); uuid != "b" {
+		t.Fatalf("dequeue uuid=%s, want b", uuid)
+	}
+	if !w.acquireSlot(reqs[1], now) {
+		t.Fatalf("acquire b should use the slot released by a")
+	}
+}